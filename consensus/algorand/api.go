@@ -0,0 +1,66 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"github.com/kaleidochain/kaleido/rpc"
+)
+
+// PrivateAlgorandAPI provides read-only access to the state of the algorand
+// protocol of the node.
+type PrivateAlgorandAPI struct {
+	pm *ProtocolManager
+}
+
+// NewPrivateAlgorandAPI creates a new algorand protocol API.
+func NewPrivateAlgorandAPI(pm *ProtocolManager) *PrivateAlgorandAPI {
+	return &PrivateAlgorandAPI{pm}
+}
+
+// StatusInfo is the local consensus status.
+type StatusInfo struct {
+	Height uint64 `json:"height"`
+	Round  uint32 `json:"round"`
+	Peers  int    `json:"peers"`
+}
+
+// Status returns the current height/round of the node and the number of peers.
+func (api *PrivateAlgorandAPI) Status() *StatusInfo {
+	height, round := api.pm.HR()
+	return &StatusInfo{
+		Height: height,
+		Round:  round,
+		Peers:  api.pm.peers.Len(),
+	}
+}
+
+// Peers returns the status of all registered algorand peers.
+func (api *PrivateAlgorandAPI) Peers() []*PeerInfo {
+	return api.pm.peers.AllInfo()
+}
+
+// APIs returns the RPC APIs of the algorand protocol.
+func (m *Miner) APIs() []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "algorand",
+			Version:   "1.0",
+			Service:   NewPrivateAlgorandAPI(m.gossiper),
+			Public:    false,
+		},
+	}
+}
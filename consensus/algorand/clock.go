@@ -0,0 +1,62 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import "time"
+
+// clock is the source of time of peers and the peer set, tests replace the
+// system clock to drive timeouts and intervals without sleeping.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) clockTimer
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is a timer created by a clock, see time.Timer. C returns nil for
+// the timers created by AfterFunc.
+type clockTimer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// systemClock implements clock with the time package.
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (systemClock) NewTimer(d time.Duration) clockTimer {
+	return systemTimer{time.NewTimer(d)}
+}
+
+func (systemClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return systemTimer{time.AfterFunc(d, f)}
+}
+
+type systemTimer struct {
+	*time.Timer
+}
+
+func (t systemTimer) C() <-chan time.Time {
+	return t.Timer.C
+}
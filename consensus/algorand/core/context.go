@@ -218,6 +218,9 @@ type Context struct {
 
 	journal *VoteJournal
 	recover bool
+
+	evidenceFeed event.Feed
+	scope        event.SubscriptionScope
 }
 
 func NewContext(eth Backend, broadcaster Broadcaster, config *params.ChainConfig, mux *event.TypeMux, engine consensus.Engine, algorandDataDir string, gasFloor, gasCeil uint64) *Context {
@@ -665,6 +668,13 @@ func (ctx *Context) Start() {
 func (ctx *Context) Stop() {
 	ctx.stopRunning()
 	ctx.stopSnapping()
+	ctx.scope.Close()
+}
+
+// SubscribeEvidence registers a subscription of EvidenceEvent, which is posted
+// once for each detected equivocation.
+func (ctx *Context) SubscribeEvidence(ch chan<- EvidenceEvent) event.Subscription {
+	return ctx.scope.Track(ctx.evidenceFeed.Subscribe(ch))
 }
 
 func (ctx *Context) StartMining() {
@@ -699,8 +709,10 @@ func (ctx *Context) broadcastLoop() {
 	}
 }
 
-func (ctx *Context) OnReceive(code uint64, data interface{}, from string) {
-	sendToMessageChan(ctx.msgChan, message{code, data, from})
+// OnReceive queues a message received from a peer, it returns false if the
+// message is dropped because the queue is full.
+func (ctx *Context) OnReceive(code uint64, data interface{}, from string) bool {
+	return sendToMessageChan(ctx.msgChan, message{code, data, from})
 }
 
 func (ctx *Context) prepareRecover() {
@@ -1051,10 +1063,24 @@ func (ctx *Context) handleProposalBlock(block *ProposalBlockData, from string) e
 	return nil
 }
 
+// addVoteAndCount counts the vote. A conflicting vote with valid signature is recorded
+// as evidence and sent to the evidence subscribers, the counted vote is kept.
+func (ctx *Context) addVoteAndCount(vote *VoteData, threshold uint64, from string) (added, newPotential, enough bool, err error) {
+	added, newPotential, enough, err = ctx.counter.AddVoteAndCount(vote, threshold)
+	if err == ErrEquivocation {
+		log.Warn("handleVote receive equivocation vote", "vote", vote, "from", from)
+		if evidence := ctx.counter.Equivocation(vote.Round, vote.Step, vote.Address); evidence != nil {
+			ctx.evidenceFeed.Send(EvidenceEvent{Signer: vote.Address, Evidence: evidence})
+		}
+	}
+	return
+}
+
 func (ctx *Context) handleVote(vote *VoteData, from string) error {
 	log.Trace("handleVote", "vote", vote, "HRS", ctx.HRS(), "from", from)
 
-	if ctx.counter.HasVote(vote.Round, vote.Step, vote.Address) {
+	conflicting := ctx.counter.IsConflictingVote(vote)
+	if !conflicting && ctx.counter.HasVote(vote.Round, vote.Step, vote.Address) {
 		return errors.New("duplicate vote")
 	}
 
@@ -1065,10 +1091,12 @@ func (ctx *Context) handleVote(vote *VoteData, from string) error {
 		return err
 	}
 
-	ctx.broadcastMsg(HasVoteMsg, ToHasVote(vote))
+	if !conflicting {
+		ctx.broadcastMsg(HasVoteMsg, ToHasVote(vote))
+	}
 
 	threshold, _ := types.GetCommitteeNumber(vote.Height, vote.Step)
-	added, newPotential, enough, err := ctx.counter.AddVoteAndCount(vote, threshold)
+	added, newPotential, enough, err := ctx.addVoteAndCount(vote, threshold, from)
 	if err != nil {
 		return err
 	}
@@ -1091,13 +1119,13 @@ func (ctx *Context) handleVote(vote *VoteData, from string) error {
 	return nil
 }
 
-func sendToMessageChan(ch chan<- message, msg message) {
+func sendToMessageChan(ch chan<- message, msg message) bool {
 	select {
 	case ch <- msg:
-		return
+		return true
 	default:
 		log.Error("message chan full", "size", len(ch))
-		return
+		return false
 	}
 }
 
@@ -0,0 +1,67 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"testing"
+
+	"github.com/kaleidochain/kaleido/common"
+	"github.com/kaleidochain/kaleido/core/types"
+)
+
+func TestAddVoteAndCountEvidence(t *testing.T) {
+	newVote := func(step uint32, value common.Hash) *VoteData {
+		return &VoteData{
+			Value: value,
+			Credential: Credential{
+				Address: common.HexToAddress("0x01"),
+				Height:  1,
+				Round:   2,
+				Step:    step,
+				Weight:  1,
+			},
+		}
+	}
+	tests := []struct {
+		step     uint32
+		evidence bool
+	}{
+		{step: types.RoundStep2Filtering, evidence: true},
+		{step: types.RoundStep3Certifying, evidence: true},
+		{step: types.RoundStep5SecondFinishing, evidence: false}, // empty then value, rules 5.2 and 5.1
+	}
+	for _, tt := range tests {
+		ctx := &Context{counter: NewHeightVoteSet()}
+		ch := make(chan EvidenceEvent, 1)
+		sub := ctx.SubscribeEvidence(ch)
+
+		ctx.addVoteAndCount(newVote(tt.step, common.HexToHash("0xe0")), 10, "peer")
+		ctx.addVoteAndCount(newVote(tt.step, common.HexToHash("0x01")), 10, "peer")
+
+		select {
+		case ev := <-ch:
+			if !tt.evidence {
+				t.Errorf("step %d: unexpected evidence %v", tt.step, ev.Evidence)
+			}
+		default:
+			if tt.evidence {
+				t.Errorf("step %d: evidence not sent", tt.step)
+			}
+		}
+		sub.Unsubscribe()
+	}
+}
@@ -18,6 +18,7 @@ package core
 
 import (
 	"fmt"
+	"reflect"
 
 	"github.com/kaleidochain/kaleido/crypto/ed25519"
 
@@ -36,18 +37,48 @@ const (
 	TimeoutMsg           = 0x06
 	HasProposalLeaderMsg = 0x07
 	HasProposalBlockMsg  = 0x08
+	VotesMsg             = 0x09 // since algorand/2
+	PingMsg              = 0x0a // since algorand/3
+	PongMsg              = 0x0b // since algorand/3
 )
 
-var CodeToString = map[uint64]string{
-	HandshakeMsg:         "HandshakeMsg",
-	StatusMsg:            "StatusMsg",
-	ProposalLeaderMsg:    "ProposalLeaderMsg",
-	ProposalBlockMsg:     "ProposalBlockMsg",
-	VoteMsg:              "VoteMsg",
-	HasVoteMsg:           "HasVoteMsg",
-	TimeoutMsg:           "TimeoutMsg",
-	HasProposalLeaderMsg: "HasProposalLeaderMsg",
-	HasProposalBlockMsg:  "HasProposalBlockMsg",
+// msgSpec describes a message code, every code must be registered in msgSpecs.
+type msgSpec struct {
+	name string
+	data reflect.Type // type of the payload
+}
+
+func newMsgSpec(name string, data interface{}) msgSpec {
+	return msgSpec{name: name, data: reflect.TypeOf(data)}
+}
+
+var msgSpecs = map[uint64]msgSpec{
+	HandshakeMsg:         newMsgSpec("HandshakeMsg", HandshakeData{}),
+	StatusMsg:            newMsgSpec("StatusMsg", StatusData{}),
+	ProposalLeaderMsg:    newMsgSpec("ProposalLeaderMsg", ProposalLeaderData{}),
+	ProposalBlockMsg:     newMsgSpec("ProposalBlockMsg", ProposalBlockData{}),
+	VoteMsg:              newMsgSpec("VoteMsg", VoteData{}),
+	HasVoteMsg:           newMsgSpec("HasVoteMsg", HasVoteData{}),
+	TimeoutMsg:           newMsgSpec("TimeoutMsg", TimeoutInfo{}),
+	HasProposalLeaderMsg: newMsgSpec("HasProposalLeaderMsg", HasProposalData{}),
+	HasProposalBlockMsg:  newMsgSpec("HasProposalBlockMsg", HasProposalData{}),
+	VotesMsg:             newMsgSpec("VotesMsg", []*VoteData{}),
+	PingMsg:              newMsgSpec("PingMsg", PingData{}),
+	PongMsg:              newMsgSpec("PongMsg", PingData{}),
+}
+
+// CodeToString maps message codes to their names, for logging.
+var CodeToString = func() map[uint64]string {
+	m := make(map[uint64]string, len(msgSpecs))
+	for code, spec := range msgSpecs {
+		m[code] = spec.name
+	}
+	return m
+}()
+
+// CodeToType returns the type of the payload of a message code, or nil if the code is unknown.
+func CodeToType(code uint64) reflect.Type {
+	return msgSpecs[code].data
 }
 
 type HandshakeData struct {
@@ -61,6 +92,12 @@ type StatusData struct {
 	Round  uint32
 }
 
+// PingData is sent in PingMsg and echoed back in PongMsg to measure the round-trip time.
+type PingData struct {
+	Nonce uint64
+	Time  uint64 // unix nano of the sender
+}
+
 type Credential struct {
 	Address common.Address   `json:"address" gencodec:"required"`
 	Height  uint64           `json:"height" gencodec:"required"`
@@ -0,0 +1,64 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestMsgCodesRegistered checks every *Msg constant declared in types.go is
+// registered in msgSpecs with its own name.
+func TestMsgCodesRegistered(t *testing.T) {
+	file, err := parser.ParseFile(token.NewFileSet(), "types.go", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count := 0
+	for name, obj := range file.Scope.Objects {
+		if obj.Kind != ast.Con || !strings.HasSuffix(name, "Msg") {
+			continue
+		}
+		count++
+
+		lit, ok := obj.Decl.(*ast.ValueSpec).Values[0].(*ast.BasicLit)
+		if !ok {
+			t.Errorf("%s: value is not a literal", name)
+			continue
+		}
+		code, err := strconv.ParseUint(lit.Value, 0, 64)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if have := CodeToString[code]; have != name {
+			t.Errorf("code %#x: name mismatch: have %q, want %q", code, have, name)
+		}
+		if CodeToType(code) == nil {
+			t.Errorf("%s: payload type not registered", name)
+		}
+	}
+	if count != len(msgSpecs) {
+		t.Errorf("registered codes mismatch: have %d, want %d", len(msgSpecs), count)
+	}
+}
@@ -37,16 +37,16 @@ const (
 
 // UserSet
 type UserSet struct {
-	exists map[string]bool
+	exists map[common.Address]bool
 }
 
 func (us *UserSet) Has(user common.Address) bool {
-	return us.exists[user.Str()]
+	return us.exists[user]
 }
 
 func (us *UserSet) Add(user common.Address) {
-	if !us.exists[user.Str()] {
-		us.exists[user.Str()] = true
+	if !us.exists[user] {
+		us.exists[user] = true
 	}
 }
 
@@ -60,12 +60,35 @@ type VoteSet struct {
 
 // ----------------
 
+// Equivocation is the evidence of a user voting two different values in the same soft or cert step
+type Equivocation struct {
+	First  *VoteData // the vote counted
+	Second *VoteData // the conflicting vote received later
+}
+
+func (e *Equivocation) String() string {
+	return fmt.Sprintf("Equivocation: %s, %s", e.First, e.Second)
+}
+
+// ErrEquivocation is returned when a user votes a different value in the same soft or cert step
+var ErrEquivocation = errors.New("equivocation vote")
+
+// EvidenceEvent is posted when an equivocation is detected, once for each user in a step.
+type EvidenceEvent struct {
+	Signer   common.Address
+	Evidence *Equivocation
+}
+
+// ----------------
+
 // StepVoteSet saves all votes for each step
 type StepVoteSet struct {
 	Values         map[string]*VoteSet // value => value info
 	MajorValue     common.Hash         // the major value reached 2/3+ (2t+1)
 	PotentialValue []common.Hash       // the potential values reached 1/3+ (t+1), maybe more than one
 	userSet        UserSet
+	userVotes      map[common.Address]*VoteData     // user => counted vote
+	equivocations  map[common.Address]*Equivocation // user => evidence, only the first one is kept
 }
 
 func RandomSelect(from []*VoteData) *VoteData {
@@ -76,6 +99,9 @@ func RandomSelect(from []*VoteData) *VoteData {
 	return msg
 }
 
+// RandomNotIn picks a random vote whose user is not in other, votes of major value
+// are preferred, then potential values, then the others. It returns nil if all votes
+// are known by other.
 func (svs *StepVoteSet) RandomNotIn(other *StepVoteSet) *VoteData {
 	if len(svs.Values) == 0 {
 		return nil
@@ -90,53 +116,109 @@ func (svs *StepVoteSet) RandomNotIn(other *StepVoteSet) *VoteData {
 	if !common.EmptyHash(svs.MajorValue) {
 		major := svs.Values[svs.MajorValue.Str()]
 
-		tmp := make([]*VoteData, 0, len(major.Votes))
-		tmp = appendNotIn(tmp, major.Votes, otherUserSet)
-		if len(tmp) > 0 {
-			return RandomSelect(tmp)
+		if vote := randomNotIn([][]*VoteData{major.Votes}, otherUserSet); vote != nil {
+			return vote
 		}
 	}
 
 	// then pick potential values
 	if len(svs.PotentialValue) > 0 {
-		total := 0
+		groups := make([][]*VoteData, 0, len(svs.PotentialValue))
 		for _, v := range svs.PotentialValue {
-			total += len(svs.Values[v.Str()].Votes)
+			groups = append(groups, svs.Values[v.Str()].Votes)
 		}
-		tmp := make([]*VoteData, 0, total)
-		for _, v := range svs.PotentialValue {
-			tmp = appendNotIn(tmp, svs.Values[v.Str()].Votes, otherUserSet)
-		}
-		if len(tmp) > 0 {
-			return RandomSelect(tmp)
+		if vote := randomNotIn(groups, otherUserSet); vote != nil {
+			return vote
 		}
 	}
 
 	// then others
-	tmp := make([]*VoteData, 0)
+	groups := make([][]*VoteData, 0, len(svs.Values))
 	for _, self := range svs.Values {
-		tmp = appendNotIn(tmp, self.Votes, otherUserSet)
+		groups = append(groups, self.Votes)
 	}
-	return RandomSelect(tmp)
+	return randomNotIn(groups, otherUserSet)
 }
 
-func appendNotIn(tmp []*VoteData, votes []*VoteData, userSet *UserSet) []*VoteData {
-	for _, vote := range votes {
-		if userSet == nil || !userSet.Has(vote.Address) {
-			tmp = append(tmp, vote)
+// randomNotInProbes is the times of random probing before scanning all votes
+const randomNotInProbes = 32
+
+// randomNotIn uniformly picks a vote in groups whose user is not in userSet, returns nil
+// if there is none. It probes random votes first, which is nearly constant time when
+// userSet does not know a fair part of the votes, and falls back to a reservoir sampling
+// over all votes. The worst case, userSet knowing all or nearly all votes, is still a
+// linear scan.
+func randomNotIn(groups [][]*VoteData, userSet *UserSet) *VoteData {
+	total := 0
+	for _, votes := range groups {
+		total += len(votes)
+	}
+	if total == 0 {
+		return nil
+	}
+
+	for i := 0; i < randomNotInProbes; i++ {
+		index := rand.Intn(total)
+		for _, votes := range groups {
+			if index < len(votes) {
+				if vote := votes[index]; userSet == nil || !userSet.Has(vote.Address) {
+					return vote
+				}
+				break
+			}
+			index -= len(votes)
+		}
+	}
+
+	var picked *VoteData
+	count := 0
+	for _, votes := range groups {
+		for _, vote := range votes {
+			if userSet != nil && userSet.Has(vote.Address) {
+				continue
+			}
+			count++
+			if rand.Intn(count) == 0 {
+				picked = vote
+			}
 		}
 	}
-	return tmp
+	return picked
 }
 
 func NewStepVoteSet() *StepVoteSet {
 	return &StepVoteSet{
 		Values:         make(map[string]*VoteSet),
 		PotentialValue: make([]common.Hash, 0, potentialValueCap),
-		userSet:        UserSet{make(map[string]bool)},
+		userSet:        UserSet{make(map[common.Address]bool)},
+		userVotes:      make(map[common.Address]*VoteData),
+		equivocations:  make(map[common.Address]*Equivocation),
 	}
 }
 
+// isConflicting returns true if the user of vote has a counted vote of different value,
+// and the equivocation is not recorded yet. Next votes never conflict, an honest user
+// may next-vote the empty value and then the value whose block arrives later (5.2, 5.1).
+func (svs *StepVoteSet) isConflicting(vote *VoteData) bool {
+	if types.VoteTypeOfStep(vote.Step) == types.VoteTypeNext {
+		return false
+	}
+
+	first, exists := svs.userVotes[vote.Address]
+	if !exists || first.Value == vote.Value {
+		return false
+	}
+	_, recorded := svs.equivocations[vote.Address]
+	return !recorded
+}
+
+func (svs *StepVoteSet) appendEquivocations(to []*Equivocation) []*Equivocation {
+	for _, e := range svs.equivocations {
+		to = append(to, e)
+	}
+	return to
+}
+
 func (svs *StepVoteSet) hasPotentialValue(value common.Hash) bool {
 	// This is a small set(<=3), we can iterate them efficiently
 	for i := 0; i < len(svs.PotentialValue); i++ {
@@ -216,6 +298,47 @@ func (rvs *RoundVoteSet) PickVoteToSend(other *RoundVoteSet) *VoteData {
 	return vote
 }
 
+// PickCertVotesToSend returns at most max cert votes not known by other, votes of the
+// major value are preferred.
+func (rvs *RoundVoteSet) PickCertVotesToSend(other *RoundVoteSet, max int) []*VoteData {
+	if rvs == nil {
+		return nil
+	}
+
+	if other == nil {
+		other = NewRoundVoteSet()
+	}
+
+	rvs.mutex.RLock()
+	defer rvs.mutex.RUnlock()
+
+	other.mutex.RLock()
+	defer other.mutex.RUnlock()
+
+	svs := rvs.certVoteSet
+	valueSets := make([]*VoteSet, 0, len(svs.Values))
+	if major, ok := svs.Values[svs.MajorValue.Str()]; ok {
+		valueSets = append(valueSets, major)
+	} else {
+		for _, vs := range svs.Values {
+			valueSets = append(valueSets, vs)
+		}
+	}
+
+	var votes []*VoteData
+	for _, vs := range valueSets {
+		for _, vote := range vs.Votes {
+			if len(votes) >= max {
+				return votes
+			}
+			if !other.certVoteSet.userSet.Has(vote.Address) {
+				votes = append(votes, vote)
+			}
+		}
+	}
+	return votes
+}
+
 func (rvs *RoundVoteSet) PickNextVoteToSend(other *RoundVoteSet) *VoteData {
 	if rvs == nil {
 		return nil
@@ -381,6 +504,14 @@ func (rvs *RoundVoteSet) AddVoteAndCount(vote *VoteData, threshold uint64) (adde
 	}
 
 	if stepVoteSet.userSet.Has(vote.Address) {
+		if stepVoteSet.isConflicting(vote) {
+			// keep the counted vote, only record the evidence
+			stepVoteSet.equivocations[vote.Address] = &Equivocation{
+				First:  stepVoteSet.userVotes[vote.Address],
+				Second: vote,
+			}
+			return false, false, false, ErrEquivocation
+		}
 		return false, false, false, errors.New("duplicate vote")
 	}
 
@@ -399,6 +530,7 @@ func (rvs *RoundVoteSet) AddVoteAndCount(vote *VoteData, threshold uint64) (adde
 		voteSet.Votes = append(voteSet.Votes, vote)
 		voteSet.Weight += vote.Weight
 		stepVoteSet.userSet.Add(vote.Address)
+		stepVoteSet.userVotes[vote.Address] = vote
 
 		added = true
 	}
@@ -427,6 +559,45 @@ func (rvs *RoundVoteSet) AddVoteAndCount(vote *VoteData, threshold uint64) (adde
 	return
 }
 
+// IsConflictingVote returns true if the user of vote has voted a different value in the same step,
+// and the equivocation is not recorded yet.
+func (rvs *RoundVoteSet) IsConflictingVote(vote *VoteData) bool {
+	rvs.mutex.RLock()
+	defer rvs.mutex.RUnlock()
+
+	svs := rvs.getStepVoteSet(vote.Step)
+	if svs == nil {
+		return false
+	}
+	return svs.isConflicting(vote)
+}
+
+// Equivocation returns the recorded equivocation of user in step, or nil
+func (rvs *RoundVoteSet) Equivocation(step uint32, user common.Address) *Equivocation {
+	rvs.mutex.RLock()
+	defer rvs.mutex.RUnlock()
+
+	svs := rvs.getStepVoteSet(step)
+	if svs == nil {
+		return nil
+	}
+	return svs.equivocations[user]
+}
+
+// Equivocations returns all recorded equivocations of this round
+func (rvs *RoundVoteSet) Equivocations() []*Equivocation {
+	rvs.mutex.RLock()
+	defer rvs.mutex.RUnlock()
+
+	var equivocations []*Equivocation
+	equivocations = rvs.softVoteSet.appendEquivocations(equivocations)
+	equivocations = rvs.certVoteSet.appendEquivocations(equivocations)
+	for _, svs := range rvs.nextVoteSet {
+		equivocations = svs.appendEquivocations(equivocations)
+	}
+	return equivocations
+}
+
 //-------------------------------------
 
 // HeightVoteSet saves all votes for this Height
@@ -490,6 +661,43 @@ func (hvs *HeightVoteSet) HasVote(round uint32, step uint32, user common.Address
 	return rvs.HasVote(step, user)
 }
 
+// IsConflictingVote returns true if the user of vote has voted a different value in the same round and step,
+// and the equivocation is not recorded yet.
+func (hvs *HeightVoteSet) IsConflictingVote(vote *VoteData) bool {
+	rvs := hvs.RoundVoteSet(vote.Round)
+	if rvs == nil {
+		return false
+	}
+
+	return rvs.IsConflictingVote(vote)
+}
+
+// Equivocation returns the recorded equivocation of user in round and step, or nil
+func (hvs *HeightVoteSet) Equivocation(round, step uint32, user common.Address) *Equivocation {
+	rvs := hvs.RoundVoteSet(round)
+	if rvs == nil {
+		return nil
+	}
+
+	return rvs.Equivocation(step, user)
+}
+
+// Equivocations returns all recorded equivocations of this height, at most one for each user in a step
+func (hvs *HeightVoteSet) Equivocations() []*Equivocation {
+	hvs.mutex.RLock()
+	rounds := make([]*RoundVoteSet, 0, len(hvs.roundVoteSet))
+	for _, rvs := range hvs.roundVoteSet {
+		rounds = append(rounds, rvs)
+	}
+	hvs.mutex.RUnlock()
+
+	var equivocations []*Equivocation
+	for _, rvs := range rounds {
+		equivocations = append(equivocations, rvs.Equivocations()...)
+	}
+	return equivocations
+}
+
 // SetHasVote sets we had received the vote for round and step by user
 func (hvs *HeightVoteSet) SetHasVote(round uint32, step uint32, user common.Address) {
 	rvs := hvs.EnsureRoundVoteSet(round)
@@ -0,0 +1,170 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/kaleidochain/kaleido/common"
+	"github.com/kaleidochain/kaleido/core/types"
+)
+
+func newTestStepVoteSet(n int, value common.Hash) *StepVoteSet {
+	svs := NewStepVoteSet()
+	voteSet := &VoteSet{}
+	for i := 0; i < n; i++ {
+		var address common.Address
+		binary.BigEndian.PutUint64(address[:], uint64(i))
+		vote := &VoteData{
+			Value: value,
+			Credential: Credential{
+				Address: address,
+				Height:  1,
+				Round:   1,
+				Step:    types.RoundStep2Filtering,
+				Weight:  1,
+			},
+		}
+		voteSet.Votes = append(voteSet.Votes, vote)
+		voteSet.Weight += vote.Weight
+		svs.userSet.Add(address)
+	}
+	svs.Values[value.Str()] = voteSet
+	return svs
+}
+
+func TestStepVoteSetRandomNotIn(t *testing.T) {
+	value := common.HexToHash("0x01")
+	svs := newTestStepVoteSet(10, value)
+
+	if vote := svs.RandomNotIn(nil); vote == nil {
+		t.Fatal("expect a vote when other is nil")
+	}
+
+	other := NewStepVoteSet()
+	for i := 0; i < 9; i++ {
+		other.userSet.Add(svs.Values[value.Str()].Votes[i].Address)
+	}
+	for i := 0; i < 100; i++ {
+		vote := svs.RandomNotIn(other)
+		if vote == nil || vote != svs.Values[value.Str()].Votes[9] {
+			t.Fatalf("expect the only unknown vote, got %v", vote)
+		}
+	}
+
+	other.userSet.Add(svs.Values[value.Str()].Votes[9].Address)
+	if vote := svs.RandomNotIn(other); vote != nil {
+		t.Fatalf("expect nil when all votes are known, got %v", vote)
+	}
+}
+
+func BenchmarkStepVoteSetRandomNotIn10k(b *testing.B) {
+	value := common.HexToHash("0x01")
+	svs := newTestStepVoteSet(10000, value)
+	other := newTestStepVoteSet(9000, value)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if svs.RandomNotIn(other) == nil {
+			b.Fatal("expect a vote")
+		}
+	}
+}
+
+func BenchmarkStepVoteSetRandomNotIn10kAllKnown(b *testing.B) {
+	value := common.HexToHash("0x01")
+	svs := newTestStepVoteSet(10000, value)
+	other := newTestStepVoteSet(10000, value)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if svs.RandomNotIn(other) != nil {
+			b.Fatal("expect no vote")
+		}
+	}
+}
+
+func TestHeightVoteSetEquivocationRecordedOnce(t *testing.T) {
+	hvs := NewHeightVoteSet()
+
+	newVote := func(value common.Hash) *VoteData {
+		return &VoteData{
+			Value: value,
+			Credential: Credential{
+				Address: common.HexToAddress("0x01"),
+				Height:  1,
+				Round:   1,
+				Step:    types.RoundStep2Filtering,
+				Weight:  1,
+			},
+		}
+	}
+	first, second := newVote(common.HexToHash("0x01")), newVote(common.HexToHash("0x02"))
+
+	if _, _, _, err := hvs.AddVoteAndCount(first, 10); err != nil {
+		t.Fatalf("add first vote: %v", err)
+	}
+	if _, _, _, err := hvs.AddVoteAndCount(second, 10); err != ErrEquivocation {
+		t.Fatalf("add conflicting vote error mismatch: have %v, want %v", err, ErrEquivocation)
+	}
+	evidence := hvs.Equivocation(1, types.RoundStep2Filtering, first.Address)
+	if evidence == nil || evidence.First != first || evidence.Second != second {
+		t.Fatalf("evidence mismatch: have %v", evidence)
+	}
+
+	// the same equivocation is reported only once
+	if _, _, _, err := hvs.AddVoteAndCount(newVote(common.HexToHash("0x03")), 10); err == ErrEquivocation {
+		t.Fatal("equivocation reported twice")
+	}
+	if have := len(hvs.Equivocations()); have != 1 {
+		t.Fatalf("equivocations mismatch: have %d, want 1", have)
+	}
+}
+
+func TestHeightVoteSetNextVoteEmptyThenValue(t *testing.T) {
+	hvs := NewHeightVoteSet()
+
+	newVote := func(value common.Hash) *VoteData {
+		return &VoteData{
+			Value: value,
+			Credential: Credential{
+				Address: common.HexToAddress("0x01"),
+				Height:  1,
+				Round:   2,
+				Step:    types.RoundStep5SecondFinishing,
+				Weight:  1,
+			},
+		}
+	}
+	empty, value := newVote(common.HexToHash("0xe0")), newVote(common.HexToHash("0x01"))
+
+	if _, _, _, err := hvs.AddVoteAndCount(empty, 10); err != nil {
+		t.Fatalf("add empty next vote: %v", err)
+	}
+	if _, _, _, err := hvs.AddVoteAndCount(value, 10); err == ErrEquivocation {
+		t.Fatal("honest next vote reported as equivocation")
+	}
+	if have := hvs.Equivocation(2, types.RoundStep5SecondFinishing, value.Address); have != nil {
+		t.Fatalf("unexpected evidence: %v", have)
+	}
+	if have := len(hvs.Equivocations()); have != 0 {
+		t.Fatalf("equivocations mismatch: have %d, want 0", have)
+	}
+}
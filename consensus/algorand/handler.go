@@ -22,6 +22,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/kaleidochain/kaleido/common"
 	"github.com/kaleidochain/kaleido/consensus"
 	"github.com/kaleidochain/kaleido/consensus/algorand/core"
@@ -34,7 +35,10 @@ import (
 	"github.com/kaleidochain/kaleido/params"
 )
 
-const gossipMaxHeightDiff = 10
+const (
+	gossipMaxHeightDiff = 10
+	staleCheckInterval  = time.Minute
+)
 
 type NodeInfo struct {
 	// TODO: we should define our own NodeInfo struct
@@ -44,22 +48,33 @@ type ProtocolManager struct {
 	eth    core.Backend
 	config *params.ChainConfig
 
-	SubProtocols []p2p.Protocol
-	peers        *peerSet
+	SubProtocols   []p2p.Protocol
+	peers          *peerSet
+	protocolConfig ProtocolConfig
+	voteCache      *voteCache
+	statusThrottle *statusThrottle
 
 	ctx *core.Context
 
+	quit chan struct{}
+
 	// wait group is used for graceful shutdowns during downloading
 	// and processing
 	wg sync.WaitGroup
 }
 
-func NewProtocolManager(eth core.Backend, config *params.ChainConfig, mux *event.TypeMux, engine consensus.Engine, ephemeralKeyDir string, gasFloor, gasCeil uint64) *ProtocolManager {
+func NewProtocolManager(eth core.Backend, config *params.ChainConfig, protocolConfig ProtocolConfig, mux *event.TypeMux, engine consensus.Engine, ephemeralKeyDir string, gasFloor, gasCeil uint64) *ProtocolManager {
 	pm := &ProtocolManager{
-		eth:    eth,
-		config: config,
-		peers:  newPeerSet(),
+		eth:            eth,
+		config:         config,
+		protocolConfig: protocolConfig.withDefaults(),
+		voteCache:      newVoteCache(voteCacheSize),
+		quit:           make(chan struct{}),
 	}
+	pm.peers = newPeerSet(pm.protocolConfig.MaxPeers)
+	pm.statusThrottle = newStatusThrottle(pm.protocolConfig.StatusInterval, pm.peers.clock, func(status *core.StatusData) {
+		pm.peers.SendStatus(status)
+	})
 	pm.ctx = core.NewContext(pm.eth, pm, pm.config, mux, engine, ephemeralKeyDir, gasFloor, gasCeil)
 
 	log.Info("Initialising Algorand protocol", "versions", ProtocolVersions)
@@ -75,7 +90,14 @@ func NewProtocolManager(eth core.Backend, config *params.ChainConfig, mux *event
 			Length:  ProtocolLengths[i],
 			Run: func(p *p2p.Peer, rw p2p.MsgReadWriter) error {
 				log.Info("New algorand peer connected", "version", version)
-				peer := newPeer(p, rw)
+				cfg := &pm.protocolConfig
+				peer := newPeer(uint32(version), p, rw,
+					withMsgQueueSize(cfg.MsgQueueSize),
+					withVoteQueueSize(cfg.VoteQueueSize),
+					withRateLimit(cfg.VoteRateLimit, cfg.VoteRateBurst, cfg.VoteAbuseWindow),
+					withMaxMsgSize(cfg.MaxMsgSize),
+					withMaxSendFailures(cfg.MaxSendFailures),
+					withClock(pm.peers.clock))
 				pm.wg.Add(1)
 				defer pm.wg.Done()
 				return pm.runPeer(peer)
@@ -96,10 +118,24 @@ func NewProtocolManager(eth core.Backend, config *params.ChainConfig, mux *event
 }
 
 func (pm *ProtocolManager) Start() {
+	if pm.protocolConfig.Expvar {
+		publishExpvar(pm)
+	}
 	pm.ctx.Start()
+
+	if pm.protocolConfig.StaleTimeout > 0 {
+		pm.wg.Add(1)
+		go pm.removeStaleLoop()
+	}
+	if metrics.Enabled {
+		pm.wg.Add(1)
+		go pm.sampleQueuesLoop()
+	}
 }
 
 func (pm *ProtocolManager) Stop() {
+	close(pm.quit)
+	pm.peers.Close() // aborts the handshakes in progress
 	pm.ctx.Stop()
 	pm.wg.Wait()
 	log.Trace("ProtocolManager Stopped")
@@ -123,8 +159,10 @@ func (pm *ProtocolManager) NodeInfo() *NodeInfo {
 func (pm *ProtocolManager) runPeer(p *peer) error {
 	// first update HR to bootstrap gossip
 	// handshake must be done at first
-	err := p.Handshake(pm.HR())
+	height, round := pm.HR()
+	err := p.Handshake(height, round, pm.protocolConfig.HandshakeTimeout, pm.peers.quit)
 	if err != nil {
+		markHandshakeFailure(err)
 		if err == io.EOF {
 			p.Log().Debug("peer closed on handshake")
 		} else {
@@ -132,6 +170,7 @@ func (pm *ProtocolManager) runPeer(p *peer) error {
 		}
 		return err
 	}
+	handshakeSuccessCounter.Inc(1)
 
 	if err := pm.peers.Register(p); err != nil {
 		p.Log().Error("Algorand register peer fail", "err", err)
@@ -157,13 +196,10 @@ func (pm *ProtocolManager) runPeer(p *peer) error {
 
 func (pm *ProtocolManager) handleMsg(p *peer) error {
 	// Read the next message from the remote peer, and ensure it's fully consumed
-	msg, err := p.rw.ReadMsg()
+	msg, err := p.readMsg()
 	if err != nil {
 		return err
 	}
-	if msg.Size > ProtocolMaxMsgSize {
-		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
-	}
 	defer msg.Discard()
 
 	switch msg.Code {
@@ -199,13 +235,54 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 		pm.ctx.OnReceive(core.ProposalBlockMsg, &data, p.String())
 
 	case core.VoteMsg:
+		if allowed, err := pm.allowVote(p); !allowed {
+			return err
+		}
+
 		var data core.VoteData
 		if err := msg.Decode(&data); err != nil {
 			return errResp(ErrDecode, "msg %v: %v", msg, err)
 		}
-		p.UpdateHR(data.Height, data.Round)
-		p.SetHasVote(core.ToHasVote(&data))
-		pm.ctx.OnReceive(core.VoteMsg, &data, p.String())
+		return pm.handleVote(p, &data)
+
+	case core.VotesMsg:
+		if !p.Supports(featureBatchedVotes) {
+			return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+		}
+
+		var votes []*core.VoteData
+		if err := msg.Decode(&votes); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if len(votes) > maxVotesPerMsg {
+			return errResp(ErrMsgTooLarge, "%d votes > %d", len(votes), maxVotesPerMsg)
+		}
+		for _, data := range votes {
+			if allowed, err := pm.allowVote(p); !allowed {
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			if err := pm.handleVote(p, data); err != nil {
+				return err
+			}
+		}
+
+	case core.PingMsg, core.PongMsg:
+		if !p.Supports(featurePing) {
+			return errResp(ErrInvalidMsgCode, "%v", msg.Code)
+		}
+
+		var data core.PingData
+		if err := msg.Decode(&data); err != nil {
+			return errResp(ErrDecode, "msg %v: %v", msg, err)
+		}
+		if msg.Code == core.PingMsg {
+			p.SendMsgAsync(core.PongMsg, &data)
+		} else {
+			p.handlePong(&data)
+		}
 
 	case core.HasVoteMsg:
 		var data core.HasVoteData
@@ -238,38 +315,102 @@ func (pm *ProtocolManager) handleMsg(p *peer) error {
 	return nil
 }
 
+// allowVote checks the inbound vote rate limit of the peer, returns false if the vote
+// should be dropped, with an error if the peer is abusive and should be disconnected.
+func (pm *ProtocolManager) allowVote(p *peer) (bool, error) {
+	if p.voteLimiter.allow(p.clock.Now()) {
+		return true, nil
+	}
+	voteDropMeter.Mark(1)
+
+	if p.voteLimiter.abusive() {
+		pm.peers.Ban(p.ID(), voteAbuseBanDuration)
+		return false, errResp(ErrVoteRateExceeded, "dropped %d votes", p.voteLimiter.dropped)
+	}
+	p.Log().Trace("Drop vote exceeding rate limit", "dropped", p.voteLimiter.dropped)
+	return false, nil
+}
+
+// handleVote passes the vote to the consensus, unless it is handled already. It
+// returns an error if the vote is too far ahead, see checkVoteHeight.
+func (pm *ProtocolManager) handleVote(p *peer, data *core.VoteData) error {
+	voteInMeter.Mark(1)
+
+	height, _ := pm.HR()
+	if err := pm.checkVoteHeight(data, height); err != nil {
+		voteSkewMeter.Mark(1)
+		return err
+	}
+
+	p.UpdateHR(data.Height, data.Round)
+	p.SetHasVote(core.ToHasVote(data))
+
+	if pm.voteCache.seen(data) {
+		return nil
+	}
+	// a vote dropped by a full queue is not cached, the copies from other peers may get through
+	if pm.ctx.OnReceive(core.VoteMsg, data, p.String()) {
+		pm.voteCache.add(data, height)
+	}
+	return nil
+}
+
+// checkVoteHeight returns an error if the vote is more than VoteHeightSkew heights
+// above height, honest peers only send votes of our height. Such a vote is not
+// stored anywhere, so that a peer can not grow our vote sets far ahead.
+func (pm *ProtocolManager) checkVoteHeight(data *core.VoteData, height uint64) error {
+	skew := pm.protocolConfig.VoteHeightSkew
+	if skew == 0 || height == 0 || data.Height <= height+skew {
+		return nil
+	}
+	return errResp(ErrVoteHeightSkew, "vote height %d > %d + %d", data.Height, height, skew)
+}
+
 func (pm *ProtocolManager) Broadcast(code uint64, data interface{}) {
 	switch code {
 	case core.StatusMsg:
-		fallthrough
+		pm.statusThrottle.update(data.(*core.StatusData))
 	case core.HasVoteMsg:
 		fallthrough
 	case core.HasProposalLeaderMsg:
 		fallthrough
 	case core.HasProposalBlockMsg:
-		pm.peers.ForEach(func(p *peer) {
+		for _, p := range pm.peers.Snapshot() {
 			p.SendMsgAsync(code, data)
-		})
+		}
 	case core.ProposalLeaderMsg:
 		msg := data.(*core.ProposalLeaderData)
-		pm.peers.ForEach(func(p *peer) {
+		for _, p := range pm.peers.Snapshot() {
 			if p.height == msg.Height { // fast check without lock
 				p.SendProposalLeaderAsync(msg)
 			}
-		})
+		}
 	case core.VoteMsg:
-		msg := data.(*core.VoteData)
-		pm.peers.ForEach(func(p *peer) {
-			if p.height == msg.Height { // fast check without lock
-				p.SendVoteAsync(msg)
-			}
-		})
+		pm.peers.BroadcastVote(data.(*core.VoteData), pm.protocolConfig.VoteFanout)
 	default:
 		log.Error("Algorand broadcast ignore unknown message",
 			"code", core.CodeToString[code], "data", data)
 	}
 }
 
+// removeStaleLoop periodically disconnects the peers not sending status.
+func (pm *ProtocolManager) removeStaleLoop() {
+	defer pm.wg.Done()
+
+	for {
+		timer := pm.peers.clock.NewTimer(staleCheckInterval)
+		select {
+		case <-timer.C():
+			if removed := pm.peers.RemoveStale(pm.protocolConfig.StaleTimeout); removed > 0 {
+				log.Debug("Algorand removed stale peers", "count", removed)
+			}
+		case <-pm.quit:
+			timer.Stop()
+			return
+		}
+	}
+}
+
 func (pm *ProtocolManager) gossipVotesLoop(p *peer) {
 	pm.wg.Add(1)
 	defer pm.wg.Done()
@@ -309,7 +450,7 @@ func (pm *ProtocolManager) gossipVotesLoop(p *peer) {
 			continue
 		}
 
-		if peerHeight+gossipMaxHeightDiff < selfHeight {
+		if peerHeight+pm.protocolConfig.GossipWindow < selfHeight { // too far behind, leave it to sync
 			needSleep = true
 			continue
 		}
@@ -327,7 +468,7 @@ func (pm *ProtocolManager) gossipVotesLoop(p *peer) {
 				}
 			}
 
-			if sent := p.PickAndSend(roundVoteSet, peerHeight, round); sent {
+			if err := p.PickVotesAndSend(roundVoteSet, peerHeight, round); err == nil {
 				p.Log().Debug("gossipVotesLoop peer is late on Height, send certificates(cached) to peer",
 					"peer", peerHeight, "self", selfHeight)
 				continue
@@ -341,8 +482,8 @@ func (pm *ProtocolManager) gossipVotesLoop(p *peer) {
 
 		if peerRound < selfRound {
 			// pick and send next vote of peerRound
-			sent := p.PickNextVoteAndSend(pm.RoundVoteSet(selfHeight, selfRound-1), selfHeight, selfRound-1)
-			if sent {
+			err := p.PickNextVoteAndSend(pm.RoundVoteSet(selfHeight, selfRound-1), selfHeight, selfRound-1)
+			if err == nil {
 				p.Log().Debug("gossipVotesLoop peer is late on Round, send next vote to peer",
 					"peer", peerRound, "self", selfRound)
 				continue
@@ -363,16 +504,16 @@ func (pm *ProtocolManager) gossipVotesLoop(p *peer) {
 		}
 
 		// here peerRound == selfRound
-		sent := p.PickAndSend(pm.RoundVoteSet(selfHeight, selfRound), selfHeight, selfRound)
-		if sent {
+		err := p.PickAndSend(pm.RoundVoteSet(selfHeight, selfRound), selfHeight, selfRound)
+		if err == nil {
 			p.Log().Debug("gossipVotesLoop pick a vote of current height to send", "height", selfHeight, "round", peerRound)
 
 			continue
 		}
 
 		if peerRound > 1 {
-			sent := p.PickNextVoteAndSend(pm.RoundVoteSet(selfHeight, selfRound-1), selfHeight, selfRound-1)
-			if sent {
+			err := p.PickNextVoteAndSend(pm.RoundVoteSet(selfHeight, selfRound-1), selfHeight, selfRound-1)
+			if err == nil {
 				p.Log().Debug("gossipVotesLoop pick a previous NextVote of current height to send", "height", selfHeight, "round", peerRound-1)
 
 				continue
@@ -426,7 +567,7 @@ func (pm *ProtocolManager) gossipDataLoop(p *peer) {
 			continue
 		}
 
-		if peerHeight+gossipMaxHeightDiff < selfHeight {
+		if peerHeight+pm.protocolConfig.GossipWindow < selfHeight { // too far behind, leave it to sync
 			needSleep = true
 			continue
 		}
@@ -538,6 +679,11 @@ func (pm *ProtocolManager) gossipDataLoop(p *peer) {
 	}
 }
 
+// SubscribeEvidence registers a subscription of the equivocations detected by the consensus.
+func (pm *ProtocolManager) SubscribeEvidence(ch chan<- core.EvidenceEvent) event.Subscription {
+	return pm.ctx.SubscribeEvidence(ch)
+}
+
 func (pm *ProtocolManager) HR() (uint64, uint32) {
 	return pm.ctx.HR()
 }
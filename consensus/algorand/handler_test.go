@@ -0,0 +1,131 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"testing"
+	"time"
+
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+	"github.com/naoina/toml"
+)
+
+// newTestProtocolManager creates a protocol manager without a backend, its
+// consensus context is never started and stays at height 0.
+func newTestProtocolManager() *ProtocolManager {
+	return &ProtocolManager{
+		peers:          newPeerSet(0),
+		protocolConfig: DefaultProtocolConfig,
+		voteCache:      newVoteCache(voteCacheSize),
+		ctx:            &core.Context{},
+		quit:           make(chan struct{}),
+	}
+}
+
+func TestProtocolConfigDefaults(t *testing.T) {
+	// a config file section only setting one field
+	var config ProtocolConfig
+	if err := toml.Unmarshal([]byte("MaxPeers = 10\n"), &config); err != nil {
+		t.Fatalf("failed to decode config: %v", err)
+	}
+	config = config.withDefaults()
+
+	want := DefaultProtocolConfig
+	want.MaxPeers = 10
+	// zero is a valid setting for these, so they stay as configured
+	want.MaxSendFailures = 0
+	want.StaleTimeout = 0
+	want.VoteRateLimit = 0
+	want.VoteRateBurst = 0
+	want.VoteAbuseWindow = 0
+	want.VoteHeightSkew = 0
+	want.StatusInterval = 0
+	if config != want {
+		t.Errorf("config mismatch:\nhave %+v\nwant %+v", config, want)
+	}
+
+	// the rate limit options are only defaulted when limiting
+	config = ProtocolConfig{VoteRateLimit: 10}.withDefaults()
+	if config.VoteRateBurst != DefaultProtocolConfig.VoteRateBurst || config.VoteAbuseWindow != DefaultProtocolConfig.VoteAbuseWindow {
+		t.Errorf("rate limit defaults mismatch: have burst %d window %v", config.VoteRateBurst, config.VoteAbuseWindow)
+	}
+}
+
+func TestCheckVoteHeight(t *testing.T) {
+	pm := &ProtocolManager{protocolConfig: DefaultProtocolConfig}
+
+	tests := []struct {
+		local, vote uint64
+		skew        uint64
+		wantErr     bool
+	}{
+		{local: 100, vote: 100, skew: 20},
+		{local: 100, vote: 50, skew: 20},
+		{local: 100, vote: 120, skew: 20},
+		{local: 100, vote: 121, skew: 20, wantErr: true},
+		{local: 100, vote: 1 << 60, skew: 20, wantErr: true},
+		{local: 0, vote: 1 << 60, skew: 20},  // height unknown yet
+		{local: 100, vote: 1 << 60, skew: 0}, // no limit
+	}
+	for i, tt := range tests {
+		pm.protocolConfig.VoteHeightSkew = tt.skew
+		err := pm.checkVoteHeight(newTestVote(tt.vote, 1, 1), tt.local)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test %d: error mismatch: have %v, want error %v", i, err, tt.wantErr)
+			continue
+		}
+		if code, ok := errCodeOf(err); err != nil && (!ok || code != ErrVoteHeightSkew) {
+			t.Errorf("test %d: error code mismatch: have %v, want %v", i, err, ErrVoteHeightSkew)
+		}
+	}
+}
+
+func TestStopAbortsHandshake(t *testing.T) {
+	pm := newTestProtocolManager()
+	pm.protocolConfig.HandshakeTimeout = time.Minute
+
+	p, remote := newTestPeer(algorand2, "peer")
+	defer remote.Close()
+
+	errCh := make(chan error, 1)
+	pm.wg.Add(1)
+	go func() {
+		defer pm.wg.Done()
+		errCh <- pm.runPeer(p)
+	}()
+
+	// the handshake is in progress once ours is sent, the remote never answers
+	msg, err := remote.ReadMsg()
+	if err != nil {
+		t.Fatalf("read handshake failed: %v", err)
+	}
+	msg.Discard()
+
+	stopped := make(chan struct{})
+	go func() {
+		pm.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop blocked by the handshake")
+	}
+	if err := <-errCh; err != errClosed {
+		t.Fatalf("handshake error mismatch: have %v, want %v", err, errClosed)
+	}
+}
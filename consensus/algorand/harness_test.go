@@ -0,0 +1,216 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kaleidochain/kaleido/common"
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+	"github.com/kaleidochain/kaleido/core/types"
+	"github.com/kaleidochain/kaleido/p2p"
+	"github.com/kaleidochain/kaleido/p2p/enode"
+)
+
+// testNode is one end of an in-memory connection between two nodes. It runs
+// the peer of the remote node like runPeer does, but without a consensus:
+// received votes are delivered to votes instead.
+type testNode struct {
+	peer  *peer
+	votes chan *core.VoteData
+}
+
+// newTestNodes connects two nodes at the given height/round with a message
+// pipe and performs the handshake.
+func newTestNodes(t *testing.T, heightA uint64, roundA uint32, heightB uint64, roundB uint32) (a, b *testNode) {
+	rwA, rwB := p2p.MsgPipe()
+	newNode := func(name string, rw p2p.MsgReadWriter) *testNode {
+		var id enode.ID
+		copy(id[:], name)
+		return &testNode{
+			peer:  newPeer(algorand3, p2p.NewPeer(id, name, nil), rw),
+			votes: make(chan *core.VoteData, 16),
+		}
+	}
+	// a.peer is node B seen by node A, and the other way round
+	a, b = newNode("b", rwA), newNode("a", rwB)
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- a.peer.Handshake(heightA, roundA, time.Second, nil) }()
+	go func() { errCh <- b.peer.Handshake(heightB, roundB, time.Second, nil) }()
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			t.Fatalf("handshake failed: %v", err)
+		}
+	}
+
+	go a.run()
+	go b.run()
+	return a, b
+}
+
+// run handles messages from the remote until the connection is closed.
+func (n *testNode) run() {
+	for {
+		if err := n.handleMsg(); err != nil {
+			return
+		}
+	}
+}
+
+func (n *testNode) handleMsg() error {
+	p := n.peer
+	msg, err := p.readMsg()
+	if err != nil {
+		return err
+	}
+	defer msg.Discard()
+
+	switch msg.Code {
+	case core.StatusMsg:
+		var status core.StatusData
+		if err := msg.Decode(&status); err != nil {
+			return err
+		}
+		p.UpdateHR(status.Height, status.Round)
+
+	case core.VoteMsg:
+		var vote core.VoteData
+		if err := msg.Decode(&vote); err != nil {
+			return err
+		}
+		p.UpdateHR(vote.Height, vote.Round)
+		p.SetHasVote(core.ToHasVote(&vote))
+		n.votes <- &vote
+
+	case core.HasVoteMsg:
+		var data core.HasVoteData
+		if err := msg.Decode(&data); err != nil {
+			return err
+		}
+		p.UpdateHR(data.Height, data.Round)
+		p.SetHasVote(&data)
+
+	default:
+		return fmt.Errorf("unexpected message %v", core.CodeToString[msg.Code])
+	}
+	return nil
+}
+
+func (n *testNode) close() {
+	n.peer.rw.(*p2p.MsgPipeRW).Close()
+}
+
+// expectVote waits for a vote from the remote.
+func (n *testNode) expectVote(t *testing.T) *core.VoteData {
+	select {
+	case vote := <-n.votes:
+		return vote
+	case <-time.After(time.Second):
+		t.Fatal("vote not received")
+		return nil
+	}
+}
+
+// expectNoVote checks no vote arrives from the remote for a while.
+func (n *testNode) expectNoVote(t *testing.T) {
+	select {
+	case vote := <-n.votes:
+		t.Fatalf("unexpected vote received: %v", vote)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func newTestVote(height uint64, round uint32, user byte) *core.VoteData {
+	return &core.VoteData{
+		Value: common.HexToHash("0x01"),
+		Credential: core.Credential{
+			Address: common.BytesToAddress([]byte{user}),
+			Height:  height,
+			Round:   round,
+			Step:    types.RoundStep2Filtering,
+			Weight:  1,
+		},
+	}
+}
+
+func TestHarnessGossipVotes(t *testing.T) {
+	a, b := newTestNodes(t, 5, 1, 5, 1)
+	defer a.close()
+
+	rvs := core.NewRoundVoteSet()
+	for i := byte(1); i <= 3; i++ {
+		rvs.AddVoteAndCount(newTestVote(5, 1, i), 100)
+	}
+
+	// A gossips its votes to B one by one, each of them once
+	received := make(map[common.Address]bool)
+	for i := 0; i < 3; i++ {
+		if err := a.peer.PickAndSend(rvs, 5, 1); err != nil {
+			t.Fatalf("pick and send vote %d: %v", i, err)
+		}
+		vote := b.expectVote(t)
+		if received[vote.Address] {
+			t.Fatalf("vote sent twice: %v", vote)
+		}
+		received[vote.Address] = true
+		if !a.peer.counter.HasVote(1, types.RoundStep2Filtering, vote.Address) {
+			t.Fatalf("vote not recorded as known by the remote: %v", vote)
+		}
+	}
+	if err := a.peer.PickAndSend(rvs, 5, 1); err != errNoVoteToSend {
+		t.Fatalf("pick and send error mismatch: have %v, want %v", err, errNoVoteToSend)
+	}
+	b.expectNoVote(t)
+
+	// B knows the votes now, so does not send them back
+	if err := b.peer.PickAndSend(rvs, 5, 1); err != errNoVoteToSend {
+		t.Fatalf("votes sent back: %v", err)
+	}
+}
+
+func TestHarnessPeerBehind(t *testing.T) {
+	a, b := newTestNodes(t, 5, 1, 4, 1)
+	defer a.close()
+
+	// B is behind, votes of height 5 are not sent to it
+	vote := newTestVote(5, 1, 1)
+	a.peer.SendVote(vote)
+	b.expectNoVote(t)
+
+	// once B announces it reached height 5, it gets the vote
+	if err := p2p.Send(b.peer.rw, core.StatusMsg, &core.StatusData{Height: 5, Round: 1}); err != nil {
+		t.Fatalf("send status: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		if height, _, _ := a.peer.HR(); height == 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("status not received")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	a.peer.SendVote(vote)
+	if have := b.expectVote(t); have.Address != vote.Address {
+		t.Fatalf("vote mismatch: have %v, want %v", have, vote)
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"expvar"
+	"sync"
+	"time"
+
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	peerGauge = metrics.NewRegisteredGauge("algorand/peers", nil)
+
+	voteInMeter   = metrics.NewRegisteredMeter("algorand/votes/in", nil)
+	voteOutMeter  = metrics.NewRegisteredMeter("algorand/votes/out", nil)
+	voteDropMeter = metrics.NewRegisteredMeter("algorand/votes/drop", nil) // over the inbound rate limit
+	voteSkewMeter = metrics.NewRegisteredMeter("algorand/votes/skew", nil) // too far above our height
+
+	voteCacheHitMeter  = metrics.NewRegisteredMeter("algorand/votes/cache/hit", nil) // handled already, from another peer
+	voteCacheMissMeter = metrics.NewRegisteredMeter("algorand/votes/cache/miss", nil)
+
+	msgChanFullMeter  = metrics.NewRegisteredMeter("algorand/queue/msg/full", nil)
+	voteChanFullMeter = metrics.NewRegisteredMeter("algorand/queue/vote/full", nil)
+
+	msgQueueGauge    = metrics.NewRegisteredGauge("algorand/queue/msg/depth", nil)  // queued messages of all peers
+	voteQueueGauge   = metrics.NewRegisteredGauge("algorand/queue/vote/depth", nil) // queued votes of all peers
+	sendFailureMeter = metrics.NewRegisteredMeter("algorand/send/fail", nil)
+
+	handshakeSuccessCounter = metrics.NewRegisteredCounter("algorand/handshake/success", nil)
+	handshakeRejectCounters = map[errCode]metrics.Counter{
+		ErrMsgTooLarge:             metrics.NewRegisteredCounter("algorand/handshake/reject/toolarge", nil),
+		ErrDecode:                  metrics.NewRegisteredCounter("algorand/handshake/reject/decode", nil),
+		ErrProtocolVersionMismatch: metrics.NewRegisteredCounter("algorand/handshake/reject/version", nil),
+		ErrNoStatusMsg:             metrics.NewRegisteredCounter("algorand/handshake/reject/nostatus", nil),
+	}
+	handshakeErrorCounter = metrics.NewRegisteredCounter("algorand/handshake/error", nil) // io errors and timeouts
+)
+
+// markHandshakeFailure counts a failed handshake by its reason.
+func markHandshakeFailure(err error) {
+	if code, ok := errCodeOf(err); ok {
+		if counter, ok := handshakeRejectCounters[code]; ok {
+			counter.Inc(1)
+			return
+		}
+	}
+	handshakeErrorCounter.Inc(1)
+}
+
+const queueSampleInterval = 3 * time.Second
+
+// sampleQueuesLoop periodically updates the queue depth gauges.
+func (pm *ProtocolManager) sampleQueuesLoop() {
+	defer pm.wg.Done()
+
+	ticker := time.NewTicker(queueSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			var msgs, votes int
+			for _, p := range pm.peers.Snapshot() {
+				msgs += len(p.statusChan) + len(p.msgChan)
+				votes += len(p.voteChan)
+			}
+			msgQueueGauge.Update(int64(msgs))
+			voteQueueGauge.Update(int64(votes))
+		case <-pm.quit:
+			return
+		}
+	}
+}
+
+var expvarOnce sync.Once
+
+// expvarStats is the snapshot of the protocol published in expvar. Vote
+// counts are only collected with metrics enabled.
+type expvarStats struct {
+	Peers     int
+	Height    uint64
+	Round     uint32
+	VotesIn   int64
+	VotesOut  int64
+	VotesDrop int64
+}
+
+// publishExpvar publishes the stats of pm under "algorand" in expvar. A name
+// can be published only once, so only the first caller is published.
+func publishExpvar(pm *ProtocolManager) {
+	expvarOnce.Do(func() {
+		expvar.Publish("algorand", expvar.Func(func() interface{} {
+			height, round := pm.HR()
+			return &expvarStats{
+				Peers:     pm.peers.Len(),
+				Height:    height,
+				Round:     round,
+				VotesIn:   voteInMeter.Count(),
+				VotesOut:  voteOutMeter.Count(),
+				VotesDrop: voteDropMeter.Count(),
+			}
+		}))
+	})
+}
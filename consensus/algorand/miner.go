@@ -48,11 +48,11 @@ type Miner struct {
 	shouldStart int32 // should start indicates whether we should start after sync
 }
 
-func NewMiner(eth core.Backend, config *params.ChainConfig, mux *event.TypeMux, engine consensus.Engine, ephemeralKeyDir string, gasFloor, gasCeil uint64) *Miner {
+func NewMiner(eth core.Backend, config *params.ChainConfig, protocolConfig ProtocolConfig, mux *event.TypeMux, engine consensus.Engine, ephemeralKeyDir string, gasFloor, gasCeil uint64) *Miner {
 	miner := &Miner{
 		mux:      mux,
 		engine:   engine,
-		gossiper: NewProtocolManager(eth, config, mux, engine, ephemeralKeyDir, gasFloor, gasCeil),
+		gossiper: NewProtocolManager(eth, config, protocolConfig, mux, engine, ephemeralKeyDir, gasFloor, gasCeil),
 		canStart: 1,
 	}
 
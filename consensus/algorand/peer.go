@@ -19,8 +19,11 @@ package algorand
 import (
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kaleidochain/kaleido/p2p/enode"
@@ -39,11 +42,29 @@ import (
 var (
 	errClosed            = errors.New("peer set is closed")
 	errAlreadyRegistered = errors.New("peer is already registered")
+	errNoVoteToSend      = errors.New("no vote to send")
+	errBanned            = errors.New("peer is banned")
+	errPeerClosed        = errors.New("peer is closed")
+	errSendTimeout       = errors.New("send queue full, timeout")
+	errTooManyPeers      = errors.New("too many peers")
 )
 
 const (
-	handshakeTimeout = 5 * time.Second
-	msgQueueSize     = 1024
+	handshakeTimeout     = 5 * time.Second
+	msgQueueSize         = 1024
+	statusQueueSize      = 16
+	statusSendTimeout    = 100 * time.Millisecond // maximum wait for space in the status queue
+	voteAbuseBanDuration = 10 * time.Minute
+	closeFlushTimeout    = time.Second // time a closing peer has to send out its queued messages
+
+	// maxVotesPerMsg is the maximum number of votes in one VotesMsg, an encoded vote
+	// is about 300 bytes, so a full batch is far below ProtocolMaxMsgSize
+	maxVotesPerMsg = 256
+
+	queueFullLogInterval = 10 * time.Second // minimum interval of queue full warnings of a peer
+
+	pingInterval      = 15 * time.Second
+	latencyEWMAWeight = 8 // a new RTT sample weighs 1/latencyEWMAWeight in the latency average
 )
 
 // peerIdKey returns id key for internal peer
@@ -51,10 +72,32 @@ func peerIdKey(id enode.ID) string {
 	return id.TerminalString()
 }
 
+// PeerInfo represents a short summary of the Algorand sub-protocol metadata known
+// about a connected peer.
 type PeerInfo struct {
-	Version uint32
-	Height  uint64
-	Round   uint32
+	ID          string `json:"id"`
+	Version     uint32 `json:"version"`
+	Height      uint64 `json:"height"`
+	Round       uint32 `json:"round"`
+	QueuedMsgs  int    `json:"queuedMsgs"`  // messages waiting in statusChan and msgChan
+	QueuedVotes int    `json:"queuedVotes"` // votes waiting in voteChan
+	QueueDrops  int64  `json:"queueDrops"`  // messages dropped because a send queue was full
+
+	LastStatusUpdate time.Time `json:"lastStatusUpdate"` // when the peer last reported its status
+}
+
+// hrSnapshot is an immutable copy of the Height/Round of a peer, it is
+// swapped atomically so that it can be read without holding peer's mutex.
+type hrSnapshot struct {
+	height uint64
+	round  uint32
+}
+
+// flushRequest asks the broadcaster to send out all queued messages before deadline,
+// done is closed when the queues are drained or the deadline is reached.
+type flushRequest struct {
+	deadline time.Time
+	done     chan struct{}
 }
 
 type message struct {
@@ -63,41 +106,144 @@ type message struct {
 }
 
 type peer struct {
+	// accessed atomically, kept first for 64-bit alignment
+	lastStatusUpdate int64 // unix nano of the last status received
+	queueDrops       int64 // messages dropped because a send queue was full
+	queueFullLogged  int64 // unix nano of the last queue full warning
+
 	id      string
 	version uint32
 
 	*p2p.Peer
 	rw                 p2p.MsgReadWriter
+	clock              clock
+	maxMsgSize         uint32
 	closeChan          chan struct{}
+	closeOnce          sync.Once
+	flushChan          chan flushRequest
+	statusChan         chan message // status messages, sent before anything else
 	msgChan            chan message
 	voteChan           chan *core.VoteData
 	proposalLeaderChan chan *core.ProposalLeaderData
+	voteLimiter        *voteLimiter // only accessed by the message handling goroutine
+
+	maxSendFailures int32 // disconnect after this many consecutive send failures, 0 means never
+	sendFailures    int32 // consecutive send failures, accessed atomically
+	failOnce        sync.Once
 
 	mutex            sync.RWMutex
 	heightUpdateTime time.Time
 	height           uint64
 	round            uint32
 	counter          *core.HeightVoteSet
+	hr               atomic.Value  // *hrSnapshot, for lock free reads of Log and String
+	pingNonce        uint64        // nonce of the outstanding ping, 0 if none
+	latency          time.Duration // moving average of the round-trip time, 0 if unknown
 
 	leaderProposalValue      map[uint32]*core.HasProposalData // round => leader's info
 	receivedProposalBlockMap map[string]bool                  // value => bool
 }
 
-func newPeer(p *p2p.Peer, rw p2p.MsgReadWriter) *peer {
+// peerOption configures a peer created by newPeer.
+type peerOption func(*peer)
+
+// withMsgQueueSize sets the capacity of the outbound message queue.
+func withMsgQueueSize(size int) peerOption {
+	return func(p *peer) {
+		p.msgChan = make(chan message, size)
+	}
+}
+
+// withVoteQueueSize sets the capacity of the outbound vote queue.
+func withVoteQueueSize(size int) peerOption {
+	return func(p *peer) {
+		p.voteChan = make(chan *core.VoteData, size)
+	}
+}
+
+// withRateLimit limits the inbound votes of the peer, see newVoteLimiter.
+func withRateLimit(rate float64, burst int, window time.Duration) peerOption {
+	return func(p *peer) {
+		p.voteLimiter = newVoteLimiter(rate, burst, window)
+	}
+}
+
+// withMaxSendFailures disconnects the peer after max consecutive send failures.
+func withMaxSendFailures(max int) peerOption {
+	return func(p *peer) {
+		p.maxSendFailures = int32(max)
+	}
+}
+
+// withMaxMsgSize sets the maximum size of a message accepted from the peer.
+func withMaxMsgSize(size uint32) peerOption {
+	return func(p *peer) {
+		p.maxMsgSize = size
+	}
+}
+
+// withClock makes the peer take time from c instead of the system clock.
+func withClock(c clock) peerOption {
+	return func(p *peer) {
+		p.clock = c
+	}
+}
+
+// newPeer creates a peer, by default with msgQueueSize long queues, no inbound
+// vote limit, ProtocolMaxMsgSize as message size limit and the system clock.
+func newPeer(version uint32, p *p2p.Peer, rw p2p.MsgReadWriter, opts ...peerOption) *peer {
 	newPeer := &peer{
 		id:                 peerIdKey(p.ID()),
+		version:            version,
 		Peer:               p,
 		rw:                 rw,
+		clock:              systemClock{},
+		maxMsgSize:         ProtocolMaxMsgSize,
 		closeChan:          make(chan struct{}),
+		flushChan:          make(chan flushRequest),
+		statusChan:         make(chan message, statusQueueSize),
 		msgChan:            make(chan message, msgQueueSize),
 		voteChan:           make(chan *core.VoteData, msgQueueSize),
 		proposalLeaderChan: make(chan *core.ProposalLeaderData, msgQueueSize),
 	}
+	for _, opt := range opts {
+		opt(newPeer)
+	}
+	newPeer.hr.Store(&hrSnapshot{})
 	return newPeer
 }
 
+// Close stops the broadcaster immediately, queued messages are discarded.
+// It is safe to call Close more than once.
 func (p *peer) Close() {
-	close(p.closeChan)
+	p.closeOnce.Do(func() {
+		close(p.closeChan)
+	})
+}
+
+// CloseGracefully lets the broadcaster send out the queued messages for up to
+// deadline, then closes the peer.
+func (p *peer) CloseGracefully(deadline time.Duration) {
+	timer := p.clock.NewTimer(deadline)
+	defer timer.Stop()
+
+	req := flushRequest{
+		deadline: p.clock.Now().Add(deadline),
+		done:     make(chan struct{}),
+	}
+
+	select {
+	case p.flushChan <- req:
+		select {
+		case <-req.done:
+		case <-timer.C():
+			p.Log().Debug("Flush queued messages timeout", "deadline", deadline)
+		}
+	case <-p.closeChan:
+	case <-timer.C():
+	}
+
+	p.Close()
 }
 
 func (p *peer) IsClosed() bool {
@@ -109,8 +255,10 @@ func (p *peer) IsClosed() bool {
 	}
 }
 
+// Log returns a logger with the peer's id and HR as context, the HR string is
+// only built if the record is actually written.
 func (p *peer) Log() log.Logger {
-	return log.New("id", p.ID(), "HR", p.hrString())
+	return log.New("id", p.ID(), "HR", log.Lazy{Fn: p.hrString})
 }
 
 // Info gathers and returns a collection of metadata known about a peer.
@@ -119,15 +267,28 @@ func (p *peer) Info() *PeerInfo {
 	defer p.mutex.RUnlock()
 
 	return &PeerInfo{
-		Version: p.version,
-		Height:  p.height,
-		Round:   p.round,
+		ID:          p.id,
+		Version:     p.version,
+		Height:      p.height,
+		Round:       p.round,
+		QueuedMsgs:  len(p.statusChan) + len(p.msgChan),
+		QueuedVotes: len(p.voteChan),
+		QueueDrops:  atomic.LoadInt64(&p.queueDrops),
+
+		LastStatusUpdate: p.LastStatusUpdate(),
 	}
 }
 
 // String implements fmt.Stringer.
 func (p *peer) String() string {
-	return fmt.Sprintf("%s-v%d-%d-%d", p.id, p.version, p.height, p.round)
+	hr := p.hr.Load().(*hrSnapshot)
+	return fmt.Sprintf("%s-v%d-%d-%d", p.id, p.version, hr.height, hr.round)
+}
+
+// LastStatusUpdate returns when the peer last reported its status, by the handshake
+// or any message carrying its Height/Round.
+func (p *peer) LastStatusUpdate() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&p.lastStatusUpdate))
 }
 
 // HR retrieves a copy of the current Height/Round of peer.
@@ -139,12 +300,22 @@ func (p *peer) HR() (uint64, uint32, time.Time) {
 }
 
 // hrString returns a string of the current Height/Round of peer.
+// It is safe to call with or without holding the mutex.
 func (p *peer) hrString() string {
-	return fmt.Sprintf("%d/%d", p.height, p.round)
+	hr := p.hr.Load().(*hrSnapshot)
+	return fmt.Sprintf("%d/%d", hr.height, hr.round)
+}
+
+// storeHRNoLock publishes the current Height/Round for hrString, must be
+// called with the mutex held after height or round changed.
+func (p *peer) storeHRNoLock() {
+	p.hr.Store(&hrSnapshot{height: p.height, round: p.round})
 }
 
 // UpdateHR updates the Height/Round of the peer.
 func (p *peer) UpdateHR(height uint64, round uint32) {
+	atomic.StoreInt64(&p.lastStatusUpdate, p.clock.Now().UnixNano())
+
 	if p.shouldIgnore(height, round) {
 		return
 	}
@@ -159,12 +330,13 @@ func (p *peer) UpdateHR(height uint64, round uint32) {
 	if height == 0 && round == types.BadRound { // 0 is for suspend gossip
 		p.Log().Debug("Peer suspend gossip", "currentHR", p.hrString())
 
-		p.heightUpdateTime = time.Now()
+		p.heightUpdateTime = p.clock.Now()
 		p.height = 0
 		p.round = types.BadRound
 		p.counter = nil
 		p.leaderProposalValue = nil
 		p.receivedProposalBlockMap = nil
+		p.storeHRNoLock()
 		return
 	}
 
@@ -174,7 +346,7 @@ func (p *peer) UpdateHR(height uint64, round uint32) {
 
 	if height > p.height {
 		// higher height
-		p.heightUpdateTime = time.Now()
+		p.heightUpdateTime = p.clock.Now()
 		p.height = height
 		p.round = round
 
@@ -186,6 +358,7 @@ func (p *peer) UpdateHR(height uint64, round uint32) {
 			p.round = round
 		}
 	}
+	p.storeHRNoLock()
 }
 
 func (p *peer) shouldIgnore(height uint64, round uint32) bool {
@@ -204,14 +377,17 @@ func (p *peer) shouldIgnore(height uint64, round uint32) bool {
 	return false
 }
 
-func (p *peer) Handshake(height uint64, round uint32) error {
+// Handshake exchanges HandshakeData with the remote, it fails if the remote does
+// not respond within timeout, or with errClosed once quit is closed. The send and
+// read goroutines exit when the connection is closed after a failure.
+func (p *peer) Handshake(height uint64, round uint32, timeout time.Duration, quit <-chan struct{}) error {
 	// Send out own handshake in a new thread
 	errCh := make(chan error, 2)
 	var handshake core.HandshakeData // safe to read after two values have been received from errCh
 
 	go func() {
 		errCh <- p2p.Send(p.rw, core.HandshakeMsg, &core.HandshakeData{
-			Version: uint32(p.version),
+			Version: p.handshakeVersion(),
 			Height:  height,
 			Round:   round,
 		})
@@ -219,125 +395,326 @@ func (p *peer) Handshake(height uint64, round uint32) error {
 	go func() {
 		errCh <- p.readStatus(&handshake)
 	}()
-	timeout := time.NewTimer(handshakeTimeout)
-	defer timeout.Stop()
+	timer := p.clock.NewTimer(timeout)
+	defer timer.Stop()
 	for i := 0; i < 2; i++ {
 		select {
 		case err := <-errCh:
 			if err != nil {
 				return err
 			}
-		case <-timeout.C:
+		case <-timer.C():
 			return p2p.DiscReadTimeout
+		case <-quit:
+			return errClosed
 		}
 	}
 
-	p.version = handshake.Version
+	// p.version keeps the version negotiated by p2p, readStatus has checked the remote
+	// agrees with it, the remote's claim is never taken as is
 	p.UpdateHR(handshake.Height, handshake.Round)
 	return nil
 }
 
 func (p *peer) readStatus(handshake *core.HandshakeData) (err error) {
-	msg, err := p.rw.ReadMsg()
+	msg, err := p.readMsg()
 	if err != nil {
 		return err
 	}
+	defer msg.Discard()
+
 	if msg.Code != core.HandshakeMsg {
 		return errResp(ErrNoStatusMsg, "first msg has code %x (!= %x)", msg.Code, core.HandshakeMsg)
 	}
-	if msg.Size > ProtocolMaxMsgSize {
-		return errResp(ErrMsgTooLarge, "%v > %v", msg.Size, ProtocolMaxMsgSize)
-	}
 	// Decode the handshake and make sure everything matches
-	if err := msg.Decode(&handshake); err != nil {
+	if err := msg.Decode(handshake); err != nil {
 		return errResp(ErrDecode, "msg %v: %v", msg, err)
 	}
-	if handshake.Version != p.version {
+	if handshake.Version != p.version && !isLegacyHandshake(handshake.Version, p.version) {
 		return errResp(ErrProtocolVersionMismatch, "%d (!= %d)", handshake.Version, p.version)
 	}
 	return nil
 }
 
-// PickNextVoteAndSend pick a next vote and send it, return if has picked a next vote
-func (p *peer) PickNextVoteAndSend(roundVoteSet *core.RoundVoteSet, height uint64, round uint32) bool {
+// legacyHandshakeVersion is the HandshakeData.Version of the nodes released before
+// protocol versioning, they only speak algorand1 and require the same value back.
+const legacyHandshakeVersion = 0
+
+// handshakeVersion returns the version to put into our HandshakeData, it is
+// legacyHandshakeVersion for algorand1 so that the legacy nodes accept us.
+func (p *peer) handshakeVersion() uint32 {
+	if p.version == algorand1 {
+		return legacyHandshakeVersion
+	}
+	return p.version
+}
+
+// isLegacyHandshake returns true if remote is the version sent by a legacy node,
+// which can only have negotiated algorand1.
+func isLegacyHandshake(remote, negotiated uint32) bool {
+	return remote == legacyHandshakeVersion && negotiated == algorand1
+}
+
+// send sends a message to the remote peer. Once maxSendFailures sends in a row
+// have failed, the connection is considered dead and the peer is disconnected,
+// which unregisters it.
+func (p *peer) send(code uint64, data interface{}) error {
+	err := p2p.Send(p.rw, code, data)
+	if err == nil {
+		atomic.StoreInt32(&p.sendFailures, 0)
+		return nil
+	}
+
+	sendFailureMeter.Mark(1)
+	failures := atomic.AddInt32(&p.sendFailures, 1)
+	if p.maxSendFailures > 0 && failures >= p.maxSendFailures {
+		p.failOnce.Do(func() {
+			p.Log().Debug("Disconnect peer failing to send", "failures", failures, "err", err)
+			go p.Disconnect(p2p.DiscNetworkError) // the caller may hold the mutex
+		})
+	}
+	return err
+}
+
+// readMsg reads the next message from the remote peer, a message larger than
+// maxMsgSize is discarded and ErrMsgTooLarge is returned.
+func (p *peer) readMsg() (p2p.Msg, error) {
+	msg, err := p.rw.ReadMsg()
+	if err != nil {
+		return msg, err
+	}
+	if msg.Size > p.maxMsgSize {
+		msg.Discard()
+		return msg, errResp(ErrMsgTooLarge, "%v > %v", msg.Size, p.maxMsgSize)
+	}
+	return msg, nil
+}
+
+// PickNextVoteAndSend pick a next vote and send it, returns errNoVoteToSend if no next vote
+// is picked, or the error of sending the picked vote
+func (p *peer) PickNextVoteAndSend(roundVoteSet *core.RoundVoteSet, height uint64, round uint32) error {
 	if roundVoteSet == nil {
-		return false
+		return errNoVoteToSend
 	}
 
-	p.mutex.Lock()
-	defer p.mutex.Unlock()
+	p.mutex.RLock()
+	if height != p.height {
+		p.mutex.RUnlock()
+		return errNoVoteToSend
+	}
+	counter := p.counter
+	vote := roundVoteSet.PickNextVoteToSend(counter.RoundVoteSet(round))
+	p.mutex.RUnlock()
+
+	if vote == nil {
+		return errNoVoteToSend
+	}
+
+	return p.sendVoteAndSetHasVote(vote, counter)
+}
+
+// PickAndSend pick a vote and send it, returns errNoVoteToSend if no vote is picked,
+// or the error of sending the picked vote
+func (p *peer) PickAndSend(roundVoteSet *core.RoundVoteSet, height uint64, round uint32) error {
+	if roundVoteSet == nil {
+		return errNoVoteToSend
+	}
 
+	p.mutex.RLock()
 	if height != p.height {
-		return false
+		p.mutex.RUnlock()
+		return errNoVoteToSend
 	}
+	counter := p.counter
+	vote := roundVoteSet.PickVoteToSend(counter.RoundVoteSet(round))
+	p.mutex.RUnlock()
 
-	vote := roundVoteSet.PickNextVoteToSend(p.counter.RoundVoteSet(round))
 	if vote == nil {
-		return false
+		return errNoVoteToSend
 	}
 
-	p.sendVoteAndSetHasVoteNoLock(vote)
-	return true
+	return p.sendVoteAndSetHasVote(vote, counter)
 }
 
-// PickAndSend pick a vote and send it, return if has picked a vote
-func (p *peer) PickAndSend(roundVoteSet *core.RoundVoteSet, height uint64, round uint32) bool {
+// PickVotesAndSend picks cert votes unknown by the peer and sends them in one VotesMsg,
+// it is used for peers catching up a former height. It falls back to PickAndSend if the
+// peer does not support VotesMsg or there is no cert vote to send.
+func (p *peer) PickVotesAndSend(roundVoteSet *core.RoundVoteSet, height uint64, round uint32) error {
 	if roundVoteSet == nil {
-		return false
+		return errNoVoteToSend
+	}
+	if !p.Supports(featureBatchedVotes) {
+		return p.PickAndSend(roundVoteSet, height, round)
+	}
+
+	p.mutex.RLock()
+	if height != p.height {
+		p.mutex.RUnlock()
+		return errNoVoteToSend
+	}
+	counter := p.counter
+	votes := roundVoteSet.PickCertVotesToSend(counter.RoundVoteSet(round), maxVotesPerMsg)
+	p.mutex.RUnlock()
+
+	if len(votes) == 0 {
+		return p.PickAndSend(roundVoteSet, height, round)
+	}
+
+	return p.sendVotesAndSetHasVote(votes, counter)
+}
+
+// sendVotesAndSetHasVote sends votes in one VotesMsg, like sendVoteAndSetHasVote.
+func (p *peer) sendVotesAndSetHasVote(votes []*core.VoteData, counter *core.HeightVoteSet) error {
+	err := p.send(core.VotesMsg, votes)
+	if err != nil {
+		p.Log().Debug("SendVotes fail", "count", len(votes), "err", err)
+		return err
 	}
+	voteOutMeter.Mark(int64(len(votes)))
 
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	if height != p.height {
-		return false
+	if p.counter != counter {
+		p.Log().Trace("SendVotes OK, but peer HR changed", "count", len(votes))
+		return nil
 	}
 
-	vote := roundVoteSet.PickVoteToSend(p.counter.RoundVoteSet(round))
-	if vote == nil {
-		return false
+	for _, data := range votes {
+		counter.SetHasVote(data.Round, data.Step, data.Address)
 	}
-
-	p.sendVoteAndSetHasVoteNoLock(vote)
-	return true
+	p.Log().Trace("SendVotes OK", "count", len(votes))
+	return nil
 }
 
 func (p *peer) SetHasVote(data *core.HasVoteData) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
-	if p.height != data.Height {
+	if p.height != data.Height || p.counter == nil {
 		return
 	}
 
 	p.counter.SetHasVote(data.Round, data.Step, data.Address)
-	p.Log().Trace("SetHasVote OK", "data", data, "HR", p.hrString())
+	p.Log().Trace("SetHasVote OK", "data", data)
 }
 
-func (p *peer) SendVote(data *core.VoteData) {
+// Ping sends a PingMsg to measure the round-trip time, the pong is handled by
+// handlePong. The peer must support featurePing.
+func (p *peer) Ping() error {
+	data := &core.PingData{Nonce: rand.Uint64() | 1, Time: uint64(p.clock.Now().UnixNano())}
+
+	p.mutex.Lock()
+	p.pingNonce = data.Nonce
+	p.mutex.Unlock()
+
+	return p.send(core.PingMsg, data)
+}
+
+// handlePong updates the latency of the peer if data answers the outstanding ping.
+func (p *peer) handlePong(data *core.PingData) {
 	p.mutex.Lock()
 	defer p.mutex.Unlock()
 
+	if p.pingNonce == 0 || data.Nonce != p.pingNonce {
+		return
+	}
+	p.pingNonce = 0
+
+	rtt := p.clock.Now().Sub(time.Unix(0, int64(data.Time)))
+	if rtt < 0 {
+		return
+	}
+	if p.latency == 0 {
+		p.latency = rtt
+	} else {
+		p.latency += (rtt - p.latency) / latencyEWMAWeight
+	}
+}
+
+// Supports returns true if the negotiated protocol version of the peer has f.
+func (p *peer) Supports(f feature) bool {
+	version, ok := featureVersions[f]
+	return ok && p.version >= version
+}
+
+// Latency returns the moving average of the measured round-trip time,
+// or 0 if it is not measured yet.
+func (p *peer) Latency() time.Duration {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	return p.latency
+}
+
+// wantsVote returns true if the peer is at the height of the vote and not known
+// to have it.
+func (p *peer) wantsVote(data *core.VoteData) bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	if p.height != data.Height || p.counter == nil {
+		return false
+	}
+	return !p.counter.HasVote(data.Round, data.Step, data.Address)
+}
+
+func (p *peer) SendVote(data *core.VoteData) {
+	p.mutex.RLock()
 	if p.height != data.Height {
+		p.mutex.RUnlock()
 		return
 	}
+	counter := p.counter
+	p.mutex.RUnlock()
 
-	if p.counter.HasVote(data.Round, data.Step, data.Address) {
+	if counter.HasVote(data.Round, data.Step, data.Address) {
 		return
 	}
 
-	p.sendVoteAndSetHasVoteNoLock(data)
+	p.sendVoteAndSetHasVote(data, counter)
 }
 
-func (p *peer) sendVoteAndSetHasVoteNoLock(data *core.VoteData) {
-	err := p2p.Send(p.rw, core.VoteMsg, data)
-	if err != nil {
+// sendQueuedVote sends a vote queued by SendVoteAsync, which marked it as known
+// by the peer already. It is dropped if the peer has moved to another height.
+func (p *peer) sendQueuedVote(data *core.VoteData) {
+	p.mutex.RLock()
+	height := p.height
+	p.mutex.RUnlock()
+	if height != data.Height {
+		return
+	}
+
+	if err := p.send(core.VoteMsg, data); err != nil {
 		p.Log().Debug("SendVote fail", "data", data, "err", err)
 		return
 	}
+	voteOutMeter.Mark(1)
+}
 
-	p.counter.SetHasVote(data.Round, data.Step, data.Address)
+// sendVoteAndSetHasVote sends the vote without holding p.mutex, so a slow
+// connection does not block status updates of the peer. counter is the vote
+// set the vote was picked against, the vote is recorded only if the peer
+// still uses it after sending, otherwise the peer has moved to another height.
+func (p *peer) sendVoteAndSetHasVote(data *core.VoteData, counter *core.HeightVoteSet) error {
+	err := p.send(core.VoteMsg, data)
+	if err != nil {
+		p.Log().Debug("SendVote fail", "data", data, "err", err)
+		return err
+	}
+	voteOutMeter.Mark(1)
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.counter != counter {
+		p.Log().Trace("SendVote OK, but peer HR changed", "data", data)
+		return nil
+	}
+
+	counter.SetHasVote(data.Round, data.Step, data.Address)
 	p.Log().Trace("SendVote OK", "data", data)
+	return nil
 }
 
 func (p *peer) SendProposalLeader(data *core.ProposalLeaderData) bool {
@@ -354,7 +731,7 @@ func (p *peer) SendProposalLeader(data *core.ProposalLeaderData) bool {
 		return false
 	}
 
-	err := p2p.Send(p.rw, core.ProposalLeaderMsg, data)
+	err := p.send(core.ProposalLeaderMsg, data)
 	if err != nil {
 		p.Log().Debug("SendProposalValueMessage fail", "proposalValue", data, "err", err)
 		return false
@@ -382,7 +759,7 @@ func (p *peer) SendProposalBlock(data *core.ProposalBlockData) bool {
 		return false
 	}
 
-	err := p2p.Send(p.rw, core.ProposalBlockMsg, data)
+	err := p.send(core.ProposalBlockMsg, data)
 	if err != nil {
 		p.Log().Debug("SendProposalBlock sent fail", "proposalBlock", data, "err", err)
 		return false
@@ -471,96 +848,337 @@ func (p *peer) PickUnknownBlockIndex(values []common.Hash) int {
 	return -1
 }
 
+// queueOf returns the queue of messages with code and its name, statuses have
+// their own queue so that they are not delayed by has-vote/has-proposal floods.
+func (p *peer) queueOf(code uint64) (chan message, string) {
+	if code == core.StatusMsg {
+		return p.statusChan, "statusChan"
+	}
+	return p.msgChan, "msgChan"
+}
+
 func (p *peer) SendMsgAsync(code uint64, data interface{}) {
+	queue, name := p.queueOf(code)
 	select {
-	case p.msgChan <- message{code: code, data: data}:
+	case queue <- message{code: code, data: data}:
 	default:
-		p.Log().Warn("msgChan full")
+		msgChanFullMeter.Mark(1)
+		p.queueFull(name)
 	}
 }
 
+// SendMsgBlocking queues a message like SendMsgAsync, but waits up to timeout
+// for space in the queue instead of dropping the message. It is for messages
+// that must not be lost, returns errSendTimeout if still can not queue it, or
+// errPeerClosed if the peer is closed meanwhile.
+func (p *peer) SendMsgBlocking(code uint64, data interface{}, timeout time.Duration) error {
+	queue, name := p.queueOf(code)
+	select {
+	case queue <- message{code: code, data: data}:
+		return nil
+	default:
+	}
+
+	timer := p.clock.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case queue <- message{code: code, data: data}:
+		return nil
+	case <-p.closeChan:
+		return errPeerClosed
+	case <-timer.C():
+		msgChanFullMeter.Mark(1)
+		p.queueFull(name)
+		p.Log().Debug("Send queue full, timeout", "queue", name, "code", core.CodeToString[code], "timeout", timeout)
+		return errSendTimeout
+	}
+}
+
+// SendVoteAsync queues the vote to push it to the peer. The vote is marked as
+// known by the peer once queued, so that gossip does not pick it again.
 func (p *peer) SendVoteAsync(data *core.VoteData) {
 	select {
 	case p.voteChan <- data:
+		p.SetHasVote(core.ToHasVote(data))
 	default:
-		p.Log().Warn("voteChan full")
+		voteChanFullMeter.Mark(1)
+		p.queueFull("voteChan")
 	}
 }
 
+// queueFull counts a message dropped because queue is full, and warns about it
+// at most once per queueFullLogInterval. Frequent drops mean the peer is too slow.
+func (p *peer) queueFull(queue string) {
+	dropped := atomic.AddInt64(&p.queueDrops, 1)
+
+	now := p.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&p.queueFullLogged)
+	if now-last < int64(queueFullLogInterval) || !atomic.CompareAndSwapInt64(&p.queueFullLogged, last, now) {
+		return
+	}
+	p.Log().Warn("Send queue full, dropping messages", "queue", queue, "dropped", dropped)
+}
+
 func (p *peer) SendProposalLeaderAsync(data *core.ProposalLeaderData) {
 	select {
 	case p.proposalLeaderChan <- data:
 	default:
-		p.Log().Warn("proposalLeaderChan full")
+		p.queueFull("proposalLeaderChan")
 	}
 }
 
 func (p *peer) broadcaster() {
+	var (
+		pingTimer clockTimer
+		pingC     <-chan time.Time
+	)
+	if p.Supports(featurePing) {
+		pingTimer = p.clock.NewTimer(pingInterval)
+		defer func() { pingTimer.Stop() }()
+		pingC = pingTimer.C()
+	}
+
 	for {
+		// statuses go first so that the remote learns our height/round at once,
+		// the other queues share the link fairly
 		select {
 		case <-p.closeChan:
 			return
-		case msg := <-p.msgChan:
-			err := p2p.Send(p.rw, msg.code, msg.data)
-			if err != nil {
-				p.Log().Debug("Send fail", "code", core.CodeToString[msg.code], "data", msg.data)
-			} else {
-				p.Log().Trace("Send sent OK", "code", core.CodeToString[msg.code], "data", msg.data)
+		case msg := <-p.statusChan:
+			p.sendMsg(msg)
+			continue
+		default:
+		}
+
+		select {
+		case <-p.closeChan:
+			return
+		case req := <-p.flushChan:
+			p.flush(req.deadline)
+			close(req.done)
+		case <-pingC:
+			if err := p.Ping(); err != nil {
+				p.Log().Debug("Ping fail", "err", err)
 			}
+			pingTimer = p.clock.NewTimer(pingInterval)
+			pingC = pingTimer.C()
+		case msg := <-p.statusChan:
+			p.sendMsg(msg)
+		case msg := <-p.msgChan:
+			p.sendMsg(msg)
 		case vote := <-p.voteChan:
-			p.SendVote(vote)
+			p.sendQueuedVote(vote)
 		case leader := <-p.proposalLeaderChan:
 			p.SendProposalLeader(leader)
 		}
 	}
 }
 
+// flush sends out queued messages until all queues are empty or deadline is reached.
+func (p *peer) flush(deadline time.Time) {
+	for p.clock.Now().Before(deadline) {
+		select {
+		case <-p.closeChan:
+			return
+		case msg := <-p.statusChan:
+			p.sendMsg(msg)
+			continue
+		default:
+		}
+
+		select {
+		case <-p.closeChan:
+			return
+		case msg := <-p.msgChan:
+			p.sendMsg(msg)
+		case vote := <-p.voteChan:
+			p.sendQueuedVote(vote)
+		case leader := <-p.proposalLeaderChan:
+			p.SendProposalLeader(leader)
+		default:
+			return
+		}
+	}
+}
+
+func (p *peer) sendMsg(msg message) {
+	err := p.send(msg.code, msg.data)
+	if err != nil {
+		p.Log().Debug("Send fail", "code", core.CodeToString[msg.code], "data", msg.data)
+	} else {
+		p.Log().Trace("Send sent OK", "code", core.CodeToString[msg.code], "data", msg.data)
+	}
+}
+
 // ------------------
 
 // peerSet represents the collection of active peers currently participating in
 // the Ethereum sub-protocol.
 type peerSet struct {
-	peers  map[string]*peer
-	lock   sync.RWMutex
-	closed bool
+	peers    map[string]*peer
+	maxPeers int                  // 0 means unlimited
+	banned   map[string]time.Time // id => ban expiry
+	lock     sync.RWMutex
+	closed   bool
+	quit     chan struct{} // closed by Close to abort handshakes in progress
+	clock    clock         // set before use, passed to the peers by the handler
+	score    peerScore     // set before use, weighs peers in WeightedPeerForHeight
+
+	rand     *rand.Rand // source of peer sampling, nil uses the global source
+	randLock sync.Mutex
 }
 
-// newPeerSet creates a new peer set to track the active participants.
-func newPeerSet() *peerSet {
+// newPeerSet creates a new peer set to track the active participants, at most
+// maxPeers of them if maxPeers is not 0.
+func newPeerSet(maxPeers int) *peerSet {
 	return &peerSet{
-		peers: make(map[string]*peer),
+		peers:    make(map[string]*peer),
+		maxPeers: maxPeers,
+		banned:   make(map[string]time.Time),
+		quit:     make(chan struct{}),
+		clock:    systemClock{},
+		score:    latencyScore,
+	}
+}
+
+// setRandSource makes the peer sampling use src and iterate peers in id order,
+// so that the selection is reproducible in tests.
+func (ps *peerSet) setRandSource(src rand.Source) {
+	ps.randLock.Lock()
+	defer ps.randLock.Unlock()
+
+	ps.rand = rand.New(src)
+}
+
+// intn returns a random int in [0,n) from the sampling source.
+func (ps *peerSet) intn(n int) int {
+	ps.randLock.Lock()
+	defer ps.randLock.Unlock()
+
+	if ps.rand == nil {
+		return rand.Intn(n)
+	}
+	return ps.rand.Intn(n)
+}
+
+// float64 returns a random float64 in [0,1) from the sampling source.
+func (ps *peerSet) float64() float64 {
+	ps.randLock.Lock()
+	defer ps.randLock.Unlock()
+
+	if ps.rand == nil {
+		return rand.Float64()
+	}
+	return ps.rand.Float64()
+}
+
+// deterministic returns true if a sampling source is set.
+func (ps *peerSet) deterministic() bool {
+	ps.randLock.Lock()
+	defer ps.randLock.Unlock()
+
+	return ps.rand != nil
+}
+
+// Ban prevents the peer with the given id from being registered for duration d.
+// It does not disconnect the peer if it is registered now.
+func (ps *peerSet) Ban(id enode.ID, d time.Duration) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	ps.banned[peerIdKey(id)] = ps.clock.Now().Add(d)
+}
+
+// purgeBannedNoLock removes expired bans, must be called with the write lock held.
+func (ps *peerSet) purgeBannedNoLock(now time.Time) {
+	for id, expiry := range ps.banned {
+		if !now.Before(expiry) {
+			delete(ps.banned, id)
+		}
 	}
 }
 
 // Register injects a new peer into the working set, or returns an error if the
-// peer is already known.
+// peer is already known. If the set is full, the most lagging peer is evicted
+// for a peer at a higher height, otherwise errTooManyPeers is returned. The
+// evicted peer sends out its queued messages for up to closeFlushTimeout before
+// it is disconnected.
 func (ps *peerSet) Register(p *peer) error {
+	evicted, err := ps.register(p)
+	if evicted != nil {
+		evicted.Log().Debug("Evict lagging peer", "newPeer", p)
+		go func() {
+			evicted.CloseGracefully(closeFlushTimeout)
+			evicted.Disconnect(p2p.DiscTooManyPeers)
+		}()
+	}
+	return err
+}
+
+func (ps *peerSet) register(p *peer) (evicted *peer, err error) {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
 
 	if ps.closed {
-		return errClosed
+		return nil, errClosed
+	}
+	ps.purgeBannedNoLock(ps.clock.Now())
+	if _, ok := ps.banned[p.id]; ok {
+		return nil, errBanned
 	}
 	if _, ok := ps.peers[p.id]; ok {
-		return errAlreadyRegistered
+		return nil, errAlreadyRegistered
+	}
+	if ps.maxPeers > 0 && len(ps.peers) >= ps.maxPeers {
+		evicted = ps.mostLaggingNoLock()
+		if evicted == nil || evicted.hr.Load().(*hrSnapshot).height >= p.hr.Load().(*hrSnapshot).height {
+			return nil, errTooManyPeers
+		}
+		delete(ps.peers, evicted.id)
 	}
 	ps.peers[p.id] = p
-	return nil
+	peerGauge.Update(int64(len(ps.peers)))
+	return evicted, nil
+}
+
+// mostLaggingNoLock returns the peer at the lowest height, must be called with the lock held.
+func (ps *peerSet) mostLaggingNoLock() *peer {
+	var (
+		lagging *peer
+		height  uint64
+	)
+	for _, p := range ps.peers {
+		if h := p.hr.Load().(*hrSnapshot).height; lagging == nil || h < height {
+			lagging, height = p, h
+		}
+	}
+	return lagging
 }
 
 // Unregister removes a remote peer from the active set, disabling any further
-// actions to/from that particular entity.
+// actions to/from that particular entity. The peer is closed at once, dropping
+// its queued messages.
 func (ps *peerSet) Unregister(p *peer) {
+	if ps.unregister(p) {
+		// the connection is usually gone, the queued messages are dropped
+		p.Close()
+	}
+}
+
+func (ps *peerSet) unregister(p *peer) bool {
 	ps.lock.Lock()
 	defer ps.lock.Unlock()
 
-	if _, ok := ps.peers[p.id]; !ok {
-		log.Warn("PeerSet has no this peer", "peer", p.id)
-		return
+	if registered, ok := ps.peers[p.id]; !ok || registered != p {
+		if !p.IsClosed() { // an evicted peer is closed by Register
+			log.Warn("PeerSet has no this peer", "peer", p.id)
+		}
+		return false
 	}
 	delete(ps.peers, p.id)
-	p.Close()
-	return
+	peerGauge.Update(int64(len(ps.peers)))
+	return true
 }
 
 // Peer retrieves the registered peer with the given id.
@@ -579,19 +1197,228 @@ func (ps *peerSet) Len() int {
 	return len(ps.peers)
 }
 
-// Close disconnects all peers.
-// No new peers can be registered after Close has returned.
+// Close disconnects all peers, after they sent out their queued messages for
+// up to closeFlushTimeout. No new peers can be registered after Close has returned.
 func (ps *peerSet) Close() {
 	ps.lock.Lock()
-	defer ps.lock.Unlock()
-
+	peers := make([]*peer, 0, len(ps.peers))
 	for _, p := range ps.peers {
-		p.Disconnect(p2p.DiscQuitting)
+		peers = append(peers, p)
+	}
+	if !ps.closed {
+		close(ps.quit)
 	}
 	ps.closed = true
+	ps.lock.Unlock()
+
+	var wg sync.WaitGroup
+	for _, p := range peers {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			p.CloseGracefully(closeFlushTimeout)
+			p.Disconnect(p2p.DiscQuitting)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// AllInfo returns the metadata of all registered peers.
+func (ps *peerSet) AllInfo() []*PeerInfo {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	infos := make([]*PeerInfo, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		infos = append(infos, p.Info())
+	}
+	return infos
+}
+
+// voteFanoutSize returns the number of peers a vote is broadcast to among n peers,
+// fanout*sqrt(n) rounded up and capped to n. fanout <= 0 means all peers.
+func voteFanoutSize(n int, fanout float64) int {
+	if fanout <= 0 {
+		return n
+	}
+	size := int(math.Ceil(fanout * math.Sqrt(float64(n))))
+	if size > n {
+		return n
+	}
+	return size
+}
+
+// SendStatus queues status to all peers, waiting up to statusSendTimeout for
+// the peers with a full status queue, a lost status stalls the gossip to us. It
+// returns once status is queued to or timed out for every peer, so statuses
+// are queued in order.
+func (ps *peerSet) SendStatus(status *core.StatusData) {
+	var wg sync.WaitGroup
+	for _, p := range ps.Snapshot() {
+		wg.Add(1)
+		go func(p *peer) {
+			defer wg.Done()
+			p.SendMsgBlocking(core.StatusMsg, status, statusSendTimeout)
+		}(p)
+	}
+	wg.Wait()
+}
+
+// BroadcastVote queues the vote to a random subset of the peers which want it,
+// see voteFanoutSize, and returns the number of peers it is queued to. The rest
+// of the peers get the vote by gossip.
+func (ps *peerSet) BroadcastVote(vote *core.VoteData, fanout float64) int {
+	var candidates []*peer
+	for _, p := range ps.Snapshot() {
+		if p.wantsVote(vote) {
+			candidates = append(candidates, p)
+		}
+	}
+
+	if ps.deterministic() {
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+	}
+
+	size := voteFanoutSize(len(candidates), fanout)
+	for i := 0; i < size; i++ {
+		j := i + ps.intn(len(candidates)-i)
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+		candidates[i].SendVoteAsync(vote)
+	}
+	return size
+}
+
+// MedianHeight returns the median height of the peers, which is robust against
+// a few peers lying about their height. Peers suspending gossip are ignored,
+// it returns 0 if there is no peer.
+func (ps *peerSet) MedianHeight() uint64 {
+	var heights []uint64
+	for _, p := range ps.Snapshot() {
+		if height, _, _ := p.HR(); height > 0 {
+			heights = append(heights, height)
+		}
+	}
+	if len(heights) == 0 {
+		return 0
+	}
+
+	sort.Slice(heights, func(i, j int) bool { return heights[i] < heights[j] })
+	return heights[len(heights)/2]
+}
+
+// PeersAbove returns the peers whose height is greater than height.
+func (ps *peerSet) PeersAbove(height uint64) []*peer {
+	var list []*peer
+	for _, p := range ps.Snapshot() {
+		if h, _, _ := p.HR(); h > height {
+			list = append(list, p)
+		}
+	}
+	return list
+}
+
+// peerScore rates a peer for WeightedPeerForHeight, a peer with a higher score
+// is picked more likely. A score <= 0 means the peer is not rated.
+type peerScore func(p *peer) float64
+
+// latencyScore scores a peer by the inverse of its latency in seconds, peers
+// not pinged yet are not rated.
+func latencyScore(p *peer) float64 {
+	latency := p.Latency()
+	if latency <= 0 {
+		return 0
+	}
+	return float64(time.Second) / float64(latency)
+}
+
+// WeightedPeerForHeight returns a random peer which has reached height, with a
+// probability proportional to its score, so that requests are spread over the
+// peers instead of all going to the best one. Peers not rated get the average
+// score, and all peers are equally likely if none is rated. It returns nil if
+// no peer has reached height.
+func (ps *peerSet) WeightedPeerForHeight(height uint64) *peer {
+	var candidates []*peer
+	for _, p := range ps.Snapshot() {
+		if h, _, _ := p.HR(); h >= height && h > 0 {
+			candidates = append(candidates, p)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+	if ps.deterministic() {
+		sort.Slice(candidates, func(i, j int) bool { return candidates[i].id < candidates[j].id })
+	}
+
+	var (
+		scores = make([]float64, len(candidates))
+		total  float64
+		rated  int
+	)
+	for i, p := range candidates {
+		if score := ps.score(p); score > 0 {
+			scores[i] = score
+			total += score
+			rated++
+		}
+	}
+	if rated == 0 {
+		return candidates[ps.intn(len(candidates))]
+	}
+
+	average := total / float64(rated)
+	for i := range scores {
+		if scores[i] == 0 {
+			scores[i] = average
+			total += average
+		}
+	}
+
+	r := ps.float64() * total
+	for i, score := range scores {
+		if r < score {
+			return candidates[i]
+		}
+		r -= score
+	}
+	return candidates[len(candidates)-1] // rounding error
+}
+
+// RemoveStale disconnects the peers not sending any status for maxAge, which
+// unregisters them, and returns their number. Peers suspending gossip are kept,
+// they may be syncing blocks.
+func (ps *peerSet) RemoveStale(maxAge time.Duration) int {
+	deadline := ps.clock.Now().Add(-maxAge)
+
+	removed := 0
+	for _, p := range ps.Snapshot() {
+		if height, _, _ := p.HR(); height == 0 {
+			continue
+		}
+		if p.LastStatusUpdate().Before(deadline) {
+			p.Log().Debug("Disconnect stale peer", "maxAge", maxAge)
+			p.Disconnect(p2p.DiscReadTimeout)
+			removed++
+		}
+	}
+	return removed
+}
+
+// Snapshot returns the registered peers, so that callers can iterate over
+// them without holding the set lock.
+func (ps *peerSet) Snapshot() []*peer {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+
+	list := make([]*peer, 0, len(ps.peers))
+	for _, p := range ps.peers {
+		list = append(list, p)
+	}
+	return list
 }
 
-// ForEach for each peer call function `do`
+// ForEach for each peer call function `do`.
+// do is called with the set lock held, use Snapshot if it may block.
 func (ps *peerSet) ForEach(do func(*peer)) {
 	ps.lock.RLock()
 	defer ps.lock.RUnlock()
@@ -0,0 +1,767 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+	"github.com/kaleidochain/kaleido/core/types"
+	"github.com/kaleidochain/kaleido/p2p"
+	"github.com/kaleidochain/kaleido/p2p/enode"
+)
+
+// newTestPeer creates a peer running version on one end of a message pipe,
+// the other end is returned to act as the remote.
+func newTestPeer(version uint32, name string, opts ...peerOption) (*peer, *p2p.MsgPipeRW) {
+	app, net := p2p.MsgPipe()
+	var id enode.ID
+	copy(id[:], name)
+	return newPeer(version, p2p.NewPeer(id, name, nil), net, opts...), app
+}
+
+func TestHandshakeKeepsNegotiatedVersion(t *testing.T) {
+	tests := []struct {
+		local   uint32
+		remote  uint32
+		wantErr bool
+	}{
+		{local: algorand2, remote: algorand2, wantErr: false},
+		{local: algorand2, remote: algorand1, wantErr: true},
+		{local: algorand2, remote: algorand2 + 1, wantErr: true},
+		{local: algorand1, remote: algorand1, wantErr: false},
+		{local: algorand1, remote: 0, wantErr: false}, // legacy node, Version not filled in
+		{local: algorand2, remote: 0, wantErr: true},
+	}
+	for i, tt := range tests {
+		p, remote := newTestPeer(tt.local, "peer")
+
+		sent := make(chan uint32, 1)
+		go func() {
+			p2p.Send(remote, core.HandshakeMsg, &core.HandshakeData{Version: tt.remote, Height: 10, Round: 2})
+			if msg, err := remote.ReadMsg(); err == nil { // consume local handshake
+				var local core.HandshakeData
+				msg.Decode(&local)
+				sent <- local.Version
+			}
+		}()
+
+		err := p.Handshake(1, 1, handshakeTimeout, nil)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("test %d: handshake error mismatch: have %v, want error %v", i, err, tt.wantErr)
+		}
+		if p.version != tt.local {
+			t.Errorf("test %d: version overwritten by remote: have %d, want %d", i, p.version, tt.local)
+		}
+		if updated := p.Info().LastStatusUpdate.UnixNano() > 0; updated == tt.wantErr {
+			t.Errorf("test %d: status update time mismatch: have updated %v, want %v", i, updated, !tt.wantErr)
+		}
+		// legacy nodes only accept their own handshake version
+		want := tt.local
+		if tt.local == algorand1 {
+			want = legacyHandshakeVersion
+		}
+		if have := <-sent; have != want {
+			t.Errorf("test %d: sent handshake version mismatch: have %d, want %d", i, have, want)
+		}
+		remote.Close()
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	clock := newManualClock()
+	p, remote := newTestPeer(algorand2, "peer", withClock(clock))
+	defer remote.Close()
+
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.Handshake(1, 1, time.Minute, nil) }()
+
+	clock.WaitForTimers(1)
+	clock.Advance(time.Minute - time.Nanosecond)
+	select {
+	case err := <-errCh:
+		t.Fatalf("handshake returned before timeout: %v", err)
+	default:
+	}
+
+	clock.Advance(time.Nanosecond)
+	if err := <-errCh; err != p2p.DiscReadTimeout {
+		t.Fatalf("handshake error mismatch: have %v, want %v", err, p2p.DiscReadTimeout)
+	}
+}
+
+func TestReadStatusDecodesHandshake(t *testing.T) {
+	p, remote := newTestPeer(algorand2, "peer")
+	defer remote.Close()
+
+	want := core.HandshakeData{Version: algorand2, Height: 100, Round: 3}
+	go p2p.Send(remote, core.HandshakeMsg, &want)
+
+	var have core.HandshakeData
+	if err := p.readStatus(&have); err != nil {
+		t.Fatalf("readStatus failed: %v", err)
+	}
+	if have != want {
+		t.Fatalf("handshake mismatch: have %+v, want %+v", have, want)
+	}
+}
+
+func TestVoteFanoutSize(t *testing.T) {
+	tests := []struct {
+		peers  int
+		fanout float64
+		want   int
+	}{
+		{peers: 0, fanout: 1, want: 0},
+		{peers: 1, fanout: 1, want: 1},
+		{peers: 10, fanout: 1, want: 4},
+		{peers: 100, fanout: 1, want: 10},
+		{peers: 10000, fanout: 1, want: 100},
+		{peers: 100, fanout: 2, want: 20},
+		{peers: 4, fanout: 3, want: 4},
+		{peers: 100, fanout: 0, want: 100},
+	}
+	for _, tt := range tests {
+		if have := voteFanoutSize(tt.peers, tt.fanout); have != tt.want {
+			t.Errorf("voteFanoutSize(%d, %v): have %d, want %d", tt.peers, tt.fanout, have, tt.want)
+		}
+	}
+}
+
+func TestBroadcastVoteSamplesPeers(t *testing.T) {
+	vote := &core.VoteData{Height: 5, Round: 1, Step: types.RoundStep2Filtering}
+
+	ps := newPeerSet(0)
+	for i := 0; i < 100; i++ {
+		p, _ := newTestPeer(algorand2, fmt.Sprintf("peer%d", i))
+		if i < 81 {
+			p.UpdateHR(vote.Height, vote.Round)
+		}
+		if err := ps.Register(p); err != nil {
+			t.Fatalf("register peer %d: %v", i, err)
+		}
+	}
+	// peers having the vote already are not candidates
+	for i, p := range ps.Snapshot() {
+		if p.height == vote.Height && i%2 == 0 {
+			p.SetHasVote(core.ToHasVote(vote))
+		}
+	}
+
+	candidates := 0
+	for _, p := range ps.Snapshot() {
+		if p.wantsVote(vote) {
+			candidates++
+		}
+	}
+	want := voteFanoutSize(candidates, 1)
+	if have := ps.BroadcastVote(vote, 1); have != want {
+		t.Fatalf("broadcast size mismatch: have %d, want %d", have, want)
+	}
+
+	queued := 0
+	for _, p := range ps.Snapshot() {
+		switch len(p.voteChan) {
+		case 0:
+		case 1:
+			if p.height != vote.Height {
+				t.Errorf("vote queued to peer %v at another height", p)
+			}
+			if p.wantsVote(vote) {
+				t.Errorf("vote queued to peer %v not marked as known", p)
+			}
+			queued++
+		default:
+			t.Errorf("vote queued %d times to peer %v", len(p.voteChan), p)
+		}
+	}
+	if queued != want {
+		t.Errorf("queued peers mismatch: have %d, want %d", queued, want)
+	}
+}
+
+func TestQueuedVoteSentOnce(t *testing.T) {
+	vote := &core.VoteData{Height: 5, Round: 1, Step: types.RoundStep2Filtering}
+	p, remote := newTestPeer(algorand2, "peer")
+	defer remote.Close()
+	p.UpdateHR(vote.Height, vote.Round)
+
+	p.SendVoteAsync(vote)
+	if p.wantsVote(vote) {
+		t.Fatal("queued vote not marked as known")
+	}
+
+	// the queued vote is still sent although marked as known
+	go p.broadcaster()
+	defer p.Close()
+	msg, err := remote.ReadMsg()
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	var have core.VoteData
+	if msg.Code != core.VoteMsg || msg.Decode(&have) != nil || have.Height != vote.Height {
+		t.Fatalf("vote mismatch: have code %d, vote %+v", msg.Code, have)
+	}
+}
+
+func TestMedianHeightAndPeersAbove(t *testing.T) {
+	ps := newPeerSet(0)
+	if have := ps.MedianHeight(); have != 0 {
+		t.Errorf("empty set median mismatch: have %d, want 0", have)
+	}
+	if have := ps.PeersAbove(0); len(have) != 0 {
+		t.Errorf("empty set peers above mismatch: have %d, want 0", len(have))
+	}
+
+	for i, height := range []uint64{7, 3, 0, 1000, 5, 6} { // 0 suspends gossip
+		p, _ := newTestPeer(algorand2, fmt.Sprintf("peer%d", i))
+		if height > 0 {
+			p.UpdateHR(height, 0)
+		}
+		if err := ps.Register(p); err != nil {
+			t.Fatalf("register peer %d: %v", i, err)
+		}
+	}
+	if have := ps.MedianHeight(); have != 6 {
+		t.Errorf("median mismatch: have %d, want 6", have)
+	}
+	if have := ps.PeersAbove(5); len(have) != 3 {
+		t.Errorf("peers above 5 mismatch: have %d, want 3", len(have))
+	}
+}
+
+func TestPingMeasuresLatency(t *testing.T) {
+	clock := newManualClock()
+	p, remote := newTestPeer(algorand3, "peer", withClock(clock))
+
+	pings := make(chan core.PingData, 1)
+	go func() {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			return
+		}
+		var data core.PingData
+		msg.Decode(&data)
+		pings <- data
+	}()
+
+	if err := p.Ping(); err != nil {
+		t.Fatalf("ping failed: %v", err)
+	}
+	data := <-pings
+	clock.Advance(10 * time.Millisecond)
+
+	// a pong with another nonce is ignored
+	p.handlePong(&core.PingData{Nonce: data.Nonce + 1, Time: data.Time})
+	if have := p.Latency(); have != 0 {
+		t.Fatalf("latency updated by unknown pong: %v", have)
+	}
+
+	p.handlePong(&data)
+	if have := p.Latency(); have != 10*time.Millisecond {
+		t.Fatalf("latency mismatch: have %v, want 10ms", have)
+	}
+}
+
+func TestOversizedMessageRejected(t *testing.T) {
+	const limit = 64
+
+	// during handshake
+	p, remote := newTestPeer(algorand2, "peer", withMaxMsgSize(limit))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p2p.Send(remote, core.HandshakeMsg, make([]byte, limit+1))
+		if msg, err := remote.ReadMsg(); err == nil {
+			msg.Discard()
+		}
+	}()
+	err := p.Handshake(1, 1, handshakeTimeout, nil)
+	if code, ok := errCodeOf(err); !ok || code != ErrMsgTooLarge {
+		t.Errorf("handshake error mismatch: have %v, want %v", err, ErrMsgTooLarge)
+	}
+	remote.Close()
+	<-done
+
+	// after handshake, the error makes runPeer return and drop the peer
+	p2, remote2 := newTestPeer(algorand2, "peer", withMaxMsgSize(limit))
+	defer remote2.Close()
+	go p2p.Send(remote2, core.HasVoteMsg, make([]byte, limit+1))
+
+	pm := &ProtocolManager{}
+	err = pm.handleMsg(p2)
+	if code, ok := errCodeOf(err); !ok || code != ErrMsgTooLarge {
+		t.Errorf("handleMsg error mismatch: have %v, want %v", err, ErrMsgTooLarge)
+	}
+}
+
+func TestFullQueuesDropMessages(t *testing.T) {
+	p, _ := newTestPeer(algorand2, "peer", withMsgQueueSize(1), withVoteQueueSize(1))
+
+	for i := 0; i < 3; i++ {
+		p.SendMsgAsync(core.HasVoteMsg, &core.HasVoteData{Height: uint64(i)})
+		p.SendVoteAsync(&core.VoteData{})
+	}
+	if have := len(p.msgChan); have != 1 {
+		t.Errorf("queued messages mismatch: have %d, want 1", have)
+	}
+	if have := len(p.voteChan); have != 1 {
+		t.Errorf("queued votes mismatch: have %d, want 1", have)
+	}
+}
+
+func TestSendMsgBlocking(t *testing.T) {
+	newFullPeer := func() (*peer, *manualClock) {
+		clock := newManualClock()
+		p, _ := newTestPeer(algorand2, "peer", withClock(clock))
+		for i := 0; i < statusQueueSize; i++ {
+			p.SendMsgAsync(core.StatusMsg, &core.StatusData{Height: uint64(i)})
+		}
+		return p, clock
+	}
+
+	// A free slot before the timeout queues the message.
+	p, clock := newFullPeer()
+	errCh := make(chan error, 1)
+	go func() { errCh <- p.SendMsgBlocking(core.StatusMsg, &core.StatusData{}, time.Second) }()
+	clock.WaitForTimers(1)
+	<-p.statusChan
+	if err := <-errCh; err != nil {
+		t.Fatalf("send error mismatch: have %v, want nil", err)
+	}
+	if have := len(p.statusChan); have != statusQueueSize {
+		t.Errorf("queued statuses mismatch: have %d, want %d", have, statusQueueSize)
+	}
+
+	// A queue still full at the timeout drops the message.
+	p, clock = newFullPeer()
+	go func() { errCh <- p.SendMsgBlocking(core.StatusMsg, &core.StatusData{}, time.Second) }()
+	clock.WaitForTimers(1)
+	clock.Advance(time.Second)
+	if err := <-errCh; err != errSendTimeout {
+		t.Fatalf("send error mismatch: have %v, want %v", err, errSendTimeout)
+	}
+
+	// Closing the peer aborts a blocked send.
+	p, clock = newFullPeer()
+	go func() { errCh <- p.SendMsgBlocking(core.StatusMsg, &core.StatusData{}, time.Second) }()
+	clock.WaitForTimers(1)
+	p.Close()
+	if err := <-errCh; err != errPeerClosed {
+		t.Fatalf("send error mismatch: have %v, want %v", err, errPeerClosed)
+	}
+}
+
+func TestBroadcastVoteDeterministic(t *testing.T) {
+	vote := &core.VoteData{Height: 5, Round: 1, Step: types.RoundStep1Proposal}
+
+	selected := func() []string {
+		ps := newPeerSet(0)
+		ps.setRandSource(rand.NewSource(1))
+		for i := 0; i < 50; i++ {
+			p, _ := newTestPeer(algorand2, fmt.Sprintf("peer%d", i))
+			p.UpdateHR(vote.Height, vote.Round)
+			ps.Register(p)
+		}
+		ps.BroadcastVote(vote, 1)
+
+		var ids []string
+		for _, p := range ps.Snapshot() {
+			if len(p.voteChan) > 0 {
+				ids = append(ids, p.id)
+			}
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	first := selected()
+	for i := 0; i < 5; i++ {
+		if have := selected(); !reflect.DeepEqual(have, first) {
+			t.Fatalf("selection differs with the same source: have %v, want %v", have, first)
+		}
+	}
+}
+
+func TestHandshakeCancel(t *testing.T) {
+	p, remote := newTestPeer(algorand2, "peer") // the remote never answers
+	defer remote.Close()                        // closing the connection releases the handshake goroutines
+	ps := newPeerSet(0)
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ps.Close()
+	}()
+
+	start := time.Now()
+	if err := p.Handshake(1, 1, 5*time.Second, ps.quit); err != errClosed {
+		t.Fatalf("handshake error mismatch: have %v, want %v", err, errClosed)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("handshake not cancelled, took %v", elapsed)
+	}
+}
+
+func TestPeerSetEvictsLaggingPeer(t *testing.T) {
+	ps := newPeerSet(2)
+
+	register := func(name string, height uint64) (*peer, error) {
+		p, _ := newTestPeer(algorand2, name)
+		p.UpdateHR(height, 0)
+		go p.broadcaster() // to flush the queue when evicted
+		return p, ps.Register(p)
+	}
+	lagging, err := register("lagging", 5)
+	if err != nil {
+		t.Fatalf("register lagging peer: %v", err)
+	}
+	if _, err := register("ahead", 10); err != nil {
+		t.Fatalf("register ahead peer: %v", err)
+	}
+
+	// a peer higher than the most lagging one replaces it
+	if _, err := register("new", 8); err != nil {
+		t.Fatalf("register new peer: %v", err)
+	}
+	if ps.Len() != 2 || ps.Peer(lagging.ID()) != nil {
+		t.Fatalf("lagging peer not evicted, peers: %d", ps.Len())
+	}
+	select {
+	case <-lagging.closeChan:
+	case <-time.After(time.Second):
+		t.Fatal("evicted peer not closed")
+	}
+
+	// a peer not higher than any is rejected
+	if _, err := register("behind", 8); err != errTooManyPeers {
+		t.Fatalf("register behind peer error mismatch: have %v, want %v", err, errTooManyPeers)
+	}
+
+	// unlimited set
+	ps = newPeerSet(0)
+	for i := 0; i < 10; i++ {
+		if _, err := register(fmt.Sprintf("peer%d", i), 1); err != nil {
+			t.Fatalf("register peer %d: %v", i, err)
+		}
+	}
+}
+
+func TestSendFailuresDisconnect(t *testing.T) {
+	// disconnected reports whether the disconnect has been triggered, it
+	// uses up failOnce, so it can only be called once for a peer
+	disconnected := func(p *peer) bool {
+		triggered := true
+		p.failOnce.Do(func() { triggered = false })
+		return triggered
+	}
+	failingPeer := func(failures int) *peer {
+		p, remote := newTestPeer(algorand2, "peer", withMaxSendFailures(3))
+		remote.Close()
+		for i := 0; i < failures; i++ {
+			if err := p.send(core.StatusMsg, &core.StatusData{}); err == nil {
+				t.Fatal("send to a closed pipe succeeded")
+			}
+		}
+		return p
+	}
+
+	if disconnected(failingPeer(2)) {
+		t.Error("disconnected before reaching the threshold")
+	}
+	if !disconnected(failingPeer(3)) {
+		t.Error("not disconnected after reaching the threshold")
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	clock := newManualClock()
+	ps := newPeerSet(0)
+	ps.clock = clock
+
+	fresh, _ := newTestPeer(algorand2, "fresh", withClock(clock))
+	stale, _ := newTestPeer(algorand2, "stale", withClock(clock))
+	suspended, _ := newTestPeer(algorand2, "suspended", withClock(clock))
+	for _, p := range []*peer{fresh, stale, suspended} {
+		p.UpdateHR(5, 1)
+		ps.Register(p)
+	}
+	suspended.UpdateHR(0, types.BadRound)
+
+	clock.Advance(time.Hour)
+	fresh.UpdateHR(6, 1)
+
+	if removed := ps.RemoveStale(time.Minute); removed != 1 {
+		t.Fatalf("removed peers mismatch: have %d, want 1", removed)
+	}
+}
+
+func TestBanExpires(t *testing.T) {
+	clock := newManualClock()
+	ps := newPeerSet(0)
+	ps.clock = clock
+
+	p, _ := newTestPeer(algorand2, "peer")
+	ps.Ban(p.ID(), time.Minute)
+	if err := ps.Register(p); err != errBanned {
+		t.Fatalf("register error mismatch: have %v, want %v", err, errBanned)
+	}
+
+	clock.Advance(time.Minute)
+	if err := ps.Register(p); err != nil {
+		t.Fatalf("register after ban expiry failed: %v", err)
+	}
+}
+
+func TestWeightedPeerForHeight(t *testing.T) {
+	ps := newPeerSet(0)
+	ps.setRandSource(rand.NewSource(1))
+
+	fast, _ := newTestPeer(algorand3, "fast")
+	slow, _ := newTestPeer(algorand3, "slow")
+	behind, _ := newTestPeer(algorand3, "behind")
+	fast.UpdateHR(10, 1)
+	slow.UpdateHR(10, 1)
+	behind.UpdateHR(5, 1)
+	for _, p := range []*peer{fast, slow, behind} {
+		ps.Register(p)
+	}
+
+	if p := ps.WeightedPeerForHeight(11); p != nil {
+		t.Fatalf("picked peer %s below height", p.id)
+	}
+
+	// no latency measured, uniform among the peers at height
+	picked := make(map[*peer]int)
+	for i := 0; i < 1000; i++ {
+		picked[ps.WeightedPeerForHeight(10)]++
+	}
+	if picked[behind] != 0 {
+		t.Fatalf("picked peer behind %d times", picked[behind])
+	}
+	if picked[fast] < 400 || picked[slow] < 400 {
+		t.Fatalf("uniform selection mismatch: fast %d, slow %d", picked[fast], picked[slow])
+	}
+
+	// fast has a 9 times higher score
+	fast.latency = 10 * time.Millisecond
+	slow.latency = 90 * time.Millisecond
+	picked = make(map[*peer]int)
+	for i := 0; i < 1000; i++ {
+		picked[ps.WeightedPeerForHeight(10)]++
+	}
+	if picked[fast] < 850 || picked[slow] < 50 {
+		t.Fatalf("weighted selection mismatch: fast %d, slow %d", picked[fast], picked[slow])
+	}
+
+	// the score function is pluggable
+	ps.score = func(p *peer) float64 {
+		if p == slow {
+			return 1
+		}
+		return 0
+	}
+	picked = make(map[*peer]int)
+	for i := 0; i < 1000; i++ {
+		picked[ps.WeightedPeerForHeight(10)]++
+	}
+	if picked[fast] < 400 || picked[slow] < 400 {
+		t.Fatalf("unrated peer selection mismatch: fast %d, slow %d", picked[fast], picked[slow])
+	}
+}
+
+func TestPeerSupports(t *testing.T) {
+	tests := []struct {
+		version      uint32
+		batchedVotes bool
+		ping         bool
+	}{
+		{version: algorand1},
+		{version: algorand2, batchedVotes: true},
+		{version: algorand3, batchedVotes: true, ping: true},
+	}
+	for _, tt := range tests {
+		p, _ := newTestPeer(tt.version, "peer")
+		if have := p.Supports(featureBatchedVotes); have != tt.batchedVotes {
+			t.Errorf("version %d: batched votes support mismatch: have %v, want %v", tt.version, have, tt.batchedVotes)
+		}
+		if have := p.Supports(featurePing); have != tt.ping {
+			t.Errorf("version %d: ping support mismatch: have %v, want %v", tt.version, have, tt.ping)
+		}
+		if p.Supports(feature(-1)) {
+			t.Errorf("version %d: unknown feature supported", tt.version)
+		}
+	}
+}
+
+func TestPickVotesAndSendMixedVersions(t *testing.T) {
+	rvs := core.NewRoundVoteSet()
+	for user := byte(1); user <= 3; user++ {
+		vote := newTestVote(5, 1, user)
+		vote.Step = types.RoundStep3Certifying
+		if _, _, _, err := rvs.AddVoteAndCount(vote, 100); err != nil {
+			t.Fatalf("add vote failed: %v", err)
+		}
+	}
+
+	tests := []struct {
+		version   uint32
+		handshake uint32 // version in the handshake of the remote
+		code      uint64
+		votes     int
+	}{
+		{version: algorand1, handshake: legacyHandshakeVersion, code: core.VoteMsg, votes: 1},
+		{version: algorand1, handshake: algorand1, code: core.VoteMsg, votes: 1},
+		{version: algorand2, handshake: algorand2, code: core.VotesMsg, votes: 3},
+	}
+	for _, tt := range tests {
+		p, remote := newTestPeer(tt.version, "peer")
+
+		go func() {
+			p2p.Send(remote, core.HandshakeMsg, &core.HandshakeData{Version: tt.handshake, Height: 5, Round: 1})
+			if msg, err := remote.ReadMsg(); err == nil { // consume local handshake
+				msg.Discard()
+			}
+		}()
+		if err := p.Handshake(5, 1, handshakeTimeout, nil); err != nil {
+			t.Fatalf("version %d: handshake failed: %v", tt.version, err)
+		}
+
+		errCh := make(chan error, 1)
+		go func() { errCh <- p.PickVotesAndSend(rvs, 5, 1) }()
+
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			t.Fatalf("version %d: read failed: %v", tt.version, err)
+		}
+		if msg.Code != tt.code {
+			t.Errorf("version %d: message code mismatch: have %v, want %v",
+				tt.version, core.CodeToString[msg.Code], core.CodeToString[tt.code])
+		}
+		var votes []*core.VoteData
+		if msg.Code == core.VotesMsg {
+			err = msg.Decode(&votes)
+		} else {
+			var vote core.VoteData
+			err = msg.Decode(&vote)
+			votes = append(votes, &vote)
+		}
+		if err != nil {
+			t.Fatalf("version %d: decode failed: %v", tt.version, err)
+		}
+		if len(votes) != tt.votes {
+			t.Errorf("version %d: vote count mismatch: have %d, want %d", tt.version, len(votes), tt.votes)
+		}
+		if err := <-errCh; err != nil {
+			t.Errorf("version %d: send failed: %v", tt.version, err)
+		}
+		remote.Close()
+	}
+}
+
+func TestCloseFlushesQueue(t *testing.T) {
+	ps := newPeerSet(0)
+	p, remote := newTestPeer(algorand2, "peer")
+	defer remote.Close()
+	if err := ps.Register(p); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	for i := uint32(1); i <= 3; i++ {
+		p.SendMsgAsync(core.StatusMsg, &core.StatusData{Height: 1, Round: i})
+	}
+	go p.broadcaster()
+
+	done := make(chan struct{})
+	go func() {
+		ps.Close()
+		close(done)
+	}()
+
+	for i := uint32(1); i <= 3; i++ {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		var status core.StatusData
+		if err := msg.Decode(&status); err != nil || status.Round != i {
+			t.Fatalf("status %d mismatch: have %+v, err %v", i, status, err)
+		}
+	}
+	<-done
+	if !p.IsClosed() {
+		t.Fatal("peer not closed")
+	}
+}
+
+func TestUnregisterClosesAtOnce(t *testing.T) {
+	ps := newPeerSet(0)
+	ps.clock = newManualClock() // never advanced, any flush would block
+	p, remote := newTestPeer(algorand2, "peer", withClock(ps.clock))
+	defer remote.Close()
+	if err := ps.Register(p); err != nil {
+		t.Fatalf("register failed: %v", err)
+	}
+
+	p.SendMsgAsync(core.StatusMsg, &core.StatusData{Height: 1})
+	ps.Unregister(p)
+	if !p.IsClosed() {
+		t.Fatal("peer not closed")
+	}
+	if ps.Peer(p.ID()) != nil {
+		t.Fatal("peer still registered")
+	}
+}
+
+func TestBroadcasterSchedulesQueues(t *testing.T) {
+	p, remote := newTestPeer(algorand2, "peer")
+	defer remote.Close()
+	p.UpdateHR(5, 1)
+
+	for i := 0; i < 100; i++ {
+		p.SendMsgAsync(core.HasVoteMsg, &core.HasVoteData{Height: 5, Round: 1})
+	}
+	p.SendVoteAsync(newTestVote(5, 1, 1))
+	p.SendMsgAsync(core.StatusMsg, &core.StatusData{Height: 5, Round: 1})
+	go p.broadcaster()
+	defer p.Close()
+
+	read := func() uint64 {
+		msg, err := remote.ReadMsg()
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		msg.Discard()
+		return msg.Code
+	}
+
+	// the status goes first although queued last
+	if code := read(); code != core.StatusMsg {
+		t.Fatalf("first message mismatch: have %v, want %v", core.CodeToString[code], core.CodeToString[core.StatusMsg])
+	}
+	// the vote is not starved by the has-vote flood
+	for i := 0; i < 50; i++ {
+		if read() == core.VoteMsg {
+			return
+		}
+	}
+	t.Fatal("vote starved by has-vote messages")
+}
@@ -16,37 +16,142 @@
 
 package algorand
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 const ProtocolName = "algorand"
-const Version = 0x1
+const (
+	algorand1 = 0x1
+	algorand2 = 0x2 // adds VotesMsg for batched votes
+	algorand3 = 0x3 // adds PingMsg/PongMsg for latency measurement
+)
+
+const Version = algorand3
+
+// feature is a part of the protocol not supported by all the versions, peers
+// are asked by peer.Supports instead of comparing versions.
+type feature int
+
+const (
+	featureBatchedVotes feature = iota // VotesMsg
+	featurePing                        // PingMsg and PongMsg
+)
+
+// featureVersions maps the features to the versions introducing them.
+var featureVersions = map[feature]uint32{
+	featureBatchedVotes: algorand2,
+	featurePing:         algorand3,
+}
 
 // Supported versions of the eth protocol (first is primary).
-var ProtocolVersions = []uint{Version}
+var ProtocolVersions = []uint{algorand3, algorand2, algorand1}
 
 // Number of implemented message corresponding to different protocol versions.
-var ProtocolLengths = []uint64{16}
+var ProtocolLengths = []uint64{16, 16, 16}
 
 const ProtocolMaxMsgSize = 10 * 1024 * 1024 // Maximum cap on the size of a protocol message
 
+// ProtocolConfig contains the tunables of the algorand protocol.
+type ProtocolConfig struct {
+	HandshakeTimeout time.Duration // Maximum time to wait for the remote handshake
+	MaxMsgSize       uint32        // Maximum size of a message, the peer sending a larger one is disconnected
+	MaxPeers         int           // Maximum number of algorand peers, 0 means unlimited
+	MaxSendFailures  int           // Consecutive send failures after which a peer is disconnected, 0 means never
+	StaleTimeout     time.Duration // Peers not sending status for this long are disconnected, 0 means never
+
+	MsgQueueSize  int // Number of outbound status and has-vote/has-proposal messages queued per peer
+	VoteQueueSize int // Number of outbound votes queued per peer
+
+	VoteRateLimit   float64       // Maximum inbound votes per second per peer, 0 means unlimited
+	VoteRateBurst   int           // Maximum inbound votes allowed in a burst
+	VoteAbuseWindow time.Duration // Peer dropping more than VoteRateLimit*VoteAbuseWindow votes in this window is disconnected
+	VoteHeightSkew  uint64        // Peer sending a vote more than VoteHeightSkew heights above ours is disconnected, 0 means no limit
+
+	VoteFanout   float64 // Own votes are pushed to VoteFanout*sqrt(peers) peers, 0 means all; received votes only spread by gossip
+	GossipWindow uint64  // Votes and proposals are gossiped to peers at most GossipWindow heights behind
+
+	StatusInterval time.Duration // Minimum interval of status broadcasts within a height, 0 means no limit
+
+	Expvar bool // Publish the protocol stats under "algorand" in expvar
+}
+
+// DefaultProtocolConfig contains the default tunables of the algorand protocol.
+var DefaultProtocolConfig = ProtocolConfig{
+	HandshakeTimeout: handshakeTimeout,
+	MaxMsgSize:       ProtocolMaxMsgSize,
+	MaxSendFailures:  5,
+	StaleTimeout:     30 * time.Minute,
+
+	MsgQueueSize:  msgQueueSize,
+	VoteQueueSize: msgQueueSize,
+
+	VoteRateLimit:   1000,
+	VoteRateBurst:   4000,
+	VoteAbuseWindow: 10 * time.Second,
+	VoteHeightSkew:  2 * gossipMaxHeightDiff,
+
+	GossipWindow: gossipMaxHeightDiff,
+
+	StatusInterval: 200 * time.Millisecond,
+}
+
+// withDefaults returns c with the zero fields, for which zero is not a valid
+// setting, taken from DefaultProtocolConfig. A config section only setting a
+// few fields leaves the others zero.
+func (c ProtocolConfig) withDefaults() ProtocolConfig {
+	d := DefaultProtocolConfig
+	if c.HandshakeTimeout == 0 {
+		c.HandshakeTimeout = d.HandshakeTimeout
+	}
+	if c.MaxMsgSize == 0 {
+		c.MaxMsgSize = d.MaxMsgSize
+	}
+	if c.MsgQueueSize == 0 {
+		c.MsgQueueSize = d.MsgQueueSize
+	}
+	if c.VoteQueueSize == 0 {
+		c.VoteQueueSize = d.VoteQueueSize
+	}
+	if c.VoteRateLimit > 0 {
+		if c.VoteRateBurst == 0 {
+			c.VoteRateBurst = d.VoteRateBurst
+		}
+		if c.VoteAbuseWindow == 0 {
+			c.VoteAbuseWindow = d.VoteAbuseWindow
+		}
+	}
+	if c.GossipWindow == 0 {
+		c.GossipWindow = d.GossipWindow
+	}
+	return c
+}
+
 type errCode int
 
 const (
-	ErrMsgTooLarge = iota
+	ErrMsgTooLarge errCode = iota
 	ErrDecode
 	ErrInvalidMsgCode
 	ErrProtocolVersionMismatch
 	ErrNoStatusMsg
 	ErrExtraHandshakeMsg
 	ErrSuspendedPeer
+	ErrVoteRateExceeded
+	ErrVoteHeightSkew
 )
 
 func (e errCode) String() string {
-	return errorToString[int(e)]
+	return errorToString[e]
+}
+
+// Error implements error, so that the codes can be used as sentinel errors.
+func (e errCode) Error() string {
+	return e.String()
 }
 
-// XXX change once legacy code is out
-var errorToString = map[int]string{
+var errorToString = map[errCode]string{
 	ErrMsgTooLarge:             "Message too long",
 	ErrDecode:                  "Invalid message",
 	ErrInvalidMsgCode:          "Invalid message code",
@@ -54,8 +159,35 @@ var errorToString = map[int]string{
 	ErrNoStatusMsg:             "No status message",
 	ErrExtraHandshakeMsg:       "Extra handshake message",
 	ErrSuspendedPeer:           "Suspended peer",
+	ErrVoteRateExceeded:        "Vote rate limit exceeded",
+	ErrVoteHeightSkew:          "Vote too far ahead",
+}
+
+// protocolError is the error returned by errResp, it carries the error code
+// to let callers find out the reason.
+type protocolError struct {
+	code errCode
+	msg  string
+}
+
+func (e *protocolError) Error() string {
+	return fmt.Sprintf("%v - %v", e.code, e.msg)
+}
+
+// Is reports whether target is the code of e, for errors.Is.
+func (e *protocolError) Is(target error) bool {
+	code, ok := target.(errCode)
+	return ok && code == e.code
+}
+
+// errCodeOf returns the code of an error returned by errResp.
+func errCodeOf(err error) (errCode, bool) {
+	if e, ok := err.(*protocolError); ok {
+		return e.code, true
+	}
+	return 0, false
 }
 
 func errResp(code errCode, format string, v ...interface{}) error {
-	return fmt.Errorf("%v - %v", code, fmt.Sprintf(format, v...))
+	return &protocolError{code: code, msg: fmt.Sprintf(format, v...)}
 }
@@ -0,0 +1,152 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+)
+
+// voteLimiter is a token bucket limiting the inbound votes of a peer.
+// Votes over the rate are dropped, and if more than rate*window votes are
+// dropped within a window, the peer is considered abusive.
+// It is only used by the message handling goroutine of the peer, so it is
+// not thread safe. A nil voteLimiter allows everything.
+type voteLimiter struct {
+	rate   float64 // tokens per second
+	burst  float64
+	window time.Duration
+
+	tokens float64
+	last   time.Time
+
+	windowStart   time.Time
+	windowDropped uint64
+	dropped       uint64 // total dropped votes
+}
+
+// newVoteLimiter creates a limiter allowing rate votes per second with burst,
+// returns nil if rate is 0, which means unlimited.
+func newVoteLimiter(rate float64, burst int, window time.Duration) *voteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &voteLimiter{
+		rate:   rate,
+		burst:  float64(burst),
+		window: window,
+		tokens: float64(burst),
+	}
+}
+
+// allow consumes a token for a vote arriving at now, returns false if the vote
+// should be dropped.
+func (l *voteLimiter) allow(now time.Time) bool {
+	if l == nil {
+		return true
+	}
+
+	if !l.last.IsZero() {
+		l.tokens += now.Sub(l.last).Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+
+	if l.tokens >= 1 {
+		l.tokens--
+		return true
+	}
+
+	if now.Sub(l.windowStart) > l.window {
+		l.windowStart = now
+		l.windowDropped = 0
+	}
+	l.windowDropped++
+	l.dropped++
+	return false
+}
+
+// abusive returns true if the peer keeps exceeding the rate in current window.
+func (l *voteLimiter) abusive() bool {
+	if l == nil {
+		return false
+	}
+	return float64(l.windowDropped) > l.rate*l.window.Seconds()
+}
+
+// statusThrottle coalesces status broadcasts, a status of a new height is sent
+// at once, round changes are sent at most once per interval with the latest status.
+type statusThrottle struct {
+	interval time.Duration
+	clock    clock
+	send     func(*core.StatusData)
+
+	lock     sync.Mutex
+	last     *core.StatusData // last sent status
+	lastTime time.Time
+	pending  *core.StatusData // latest status not sent yet
+	timer    clockTimer
+}
+
+func newStatusThrottle(interval time.Duration, clock clock, send func(*core.StatusData)) *statusThrottle {
+	return &statusThrottle{
+		interval: interval,
+		clock:    clock,
+		send:     send,
+	}
+}
+
+// update broadcasts status now or when the interval after the last broadcast is over.
+func (t *statusThrottle) update(status *core.StatusData) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	elapsed := t.clock.Now().Sub(t.lastTime)
+	if t.last == nil || status.Height > t.last.Height || elapsed >= t.interval {
+		t.sendNoLock(status)
+		return
+	}
+
+	t.pending = status
+	if t.timer == nil {
+		t.timer = t.clock.AfterFunc(t.interval-elapsed, t.flush)
+	}
+}
+
+func (t *statusThrottle) flush() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.timer = nil
+	if t.pending != nil {
+		t.sendNoLock(t.pending)
+	}
+}
+
+// sendNoLock sends status, must be called with the lock held so that statuses
+// are sent in order.
+func (t *statusThrottle) sendNoLock(status *core.StatusData) {
+	t.last, t.lastTime, t.pending = status, t.clock.Now(), nil
+	t.send(status)
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+)
+
+func TestStatusThrottle(t *testing.T) {
+	var (
+		lock sync.Mutex
+		sent []core.StatusData
+	)
+	sentStatus := func() []core.StatusData {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]core.StatusData(nil), sent...)
+	}
+	clock := newManualClock()
+	throttle := newStatusThrottle(50*time.Millisecond, clock, func(status *core.StatusData) {
+		lock.Lock()
+		defer lock.Unlock()
+		sent = append(sent, *status)
+	})
+
+	throttle.update(&core.StatusData{Height: 1, Round: 1})
+	throttle.update(&core.StatusData{Height: 1, Round: 2})
+	throttle.update(&core.StatusData{Height: 1, Round: 3})
+	want := []core.StatusData{{Height: 1, Round: 1}}
+	if have := sentStatus(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("round changes not coalesced: have %v, want %v", have, want)
+	}
+
+	clock.Advance(49 * time.Millisecond)
+	if have := sentStatus(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("status sent before interval: have %v, want %v", have, want)
+	}
+
+	clock.Advance(time.Millisecond)
+	want = append(want, core.StatusData{Height: 1, Round: 3})
+	if have := sentStatus(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("latest status not sent after interval: have %v, want %v", have, want)
+	}
+
+	throttle.update(&core.StatusData{Height: 2, Round: 1})
+	want = append(want, core.StatusData{Height: 2, Round: 1})
+	if have := sentStatus(); !reflect.DeepEqual(have, want) {
+		t.Fatalf("new height not sent at once: have %v, want %v", have, want)
+	}
+}
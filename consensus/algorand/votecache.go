@@ -0,0 +1,67 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"github.com/ethereum/go-ethereum/rlp"
+	lru "github.com/hashicorp/golang-lru"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/kaleidochain/kaleido/common"
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+)
+
+const voteCacheSize = 16384
+
+// voteCache remembers the recently handled votes of all peers, so that a vote
+// forwarded by several peers is handed to the consensus only once.
+type voteCache struct {
+	cache *lru.Cache // vote hash => struct{}
+}
+
+func newVoteCache(size int) *voteCache {
+	cache, _ := lru.New(size)
+	return &voteCache{cache: cache}
+}
+
+// seen returns true if the vote has been handled already.
+func (c *voteCache) seen(vote *core.VoteData) bool {
+	if c.cache.Contains(voteHash(vote)) {
+		voteCacheHitMeter.Mark(1)
+		return true
+	}
+	voteCacheMissMeter.Mark(1)
+	return false
+}
+
+// add records the vote handed to the consensus if it is not above height, votes
+// of future heights are dropped by the consensus and must be handled again once
+// the node reaches their height.
+func (c *voteCache) add(vote *core.VoteData, height uint64) {
+	if vote.Height <= height {
+		c.cache.Add(voteHash(vote), struct{}{})
+	}
+}
+
+// voteHash hashes the whole vote including the signature, so that a forged
+// copy of a vote does not shadow the genuine one.
+func voteHash(vote *core.VoteData) (h common.Hash) {
+	hw := sha3.NewLegacyKeccak256()
+	_ = rlp.Encode(hw, vote)
+	hw.Sum(h[:0])
+	return h
+}
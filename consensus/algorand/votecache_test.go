@@ -0,0 +1,67 @@
+// Copyright (c) 2019 The kaleido Authors
+// This file is part of kaleido
+//
+// kaleido is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// kaleido is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with kaleido. If not, see <https://www.gnu.org/licenses/>.
+
+package algorand
+
+import (
+	"testing"
+
+	"github.com/kaleidochain/kaleido/consensus/algorand/core"
+	"github.com/kaleidochain/kaleido/core/types"
+)
+
+func TestVoteCacheSeen(t *testing.T) {
+	c := newVoteCache(16)
+
+	vote := &core.VoteData{}
+	vote.Height, vote.Round, vote.Step = 10, 1, types.RoundStep2Filtering
+	if c.seen(vote) {
+		t.Fatal("first vote is seen")
+	}
+	c.add(vote, 10)
+	if !c.seen(vote) {
+		t.Fatal("duplicate vote is not seen")
+	}
+
+	// a copy with another signature is handled on its own
+	forged := *vote
+	forged.ESignValue.Sig[0] ^= 1
+	if c.seen(&forged) {
+		t.Fatal("forged vote is seen")
+	}
+
+	// future votes are not remembered
+	future := *vote
+	future.Height = 11
+	c.add(&future, 10)
+	if c.seen(&future) {
+		t.Fatal("future vote is seen")
+	}
+}
+
+func TestHandleVoteQueueFull(t *testing.T) {
+	pm := newTestProtocolManager()
+	pm.ctx.Height = 10 // the queue of the context not started is always full
+
+	p, _ := newTestPeer(algorand2, "peer")
+	vote := newTestVote(10, 1, 1)
+	if err := pm.handleVote(p, vote); err != nil {
+		t.Fatalf("handle vote failed: %v", err)
+	}
+	if pm.voteCache.seen(vote) {
+		t.Fatal("vote dropped by the full queue is cached")
+	}
+}
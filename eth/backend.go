@@ -205,7 +205,7 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 	}
 
 	if eth.chainConfig.Algorand != nil {
-		eth.miner = algorand.NewMiner(eth, eth.chainConfig, eth.EventMux(), eth.engine, ctx.ResolvePath(""), config.MinerGasFloor, config.MinerGasCeil)
+		eth.miner = algorand.NewMiner(eth, eth.chainConfig, config.Algorand, eth.EventMux(), eth.engine, ctx.ResolvePath(""), config.MinerGasFloor, config.MinerGasCeil)
 	} else {
 		eth.miner = miner.New(eth, eth.chainConfig, eth.EventMux(), eth.engine, config.MinerRecommit, config.MinerGasFloor, config.MinerGasCeil, eth.isLocalBlock)
 	}
@@ -297,6 +297,11 @@ func (s *Ethereum) APIs() []rpc.API {
 	// Append any APIs exposed explicitly by the consensus engine
 	apis = append(apis, s.engine.APIs(s.BlockChain())...)
 
+	// Append the algorand protocol APIs if it is running
+	if m, ok := s.miner.(*algorand.Miner); ok {
+		apis = append(apis, m.APIs()...)
+	}
+
 	// Append all the local APIs and return
 	return append(apis, []rpc.API{
 		{
@@ -26,6 +26,7 @@ import (
 
 	"github.com/kaleidochain/kaleido/common"
 	"github.com/kaleidochain/kaleido/common/hexutil"
+	"github.com/kaleidochain/kaleido/consensus/algorand"
 	"github.com/kaleidochain/kaleido/consensus/ethash"
 	"github.com/kaleidochain/kaleido/core"
 	"github.com/kaleidochain/kaleido/eth/downloader"
@@ -43,6 +44,7 @@ var DefaultConfig = Config{
 		DatasetsInMem:  1,
 		DatasetsOnDisk: 2,
 	},
+	Algorand:       algorand.DefaultProtocolConfig,
 	NetworkId:      888,
 	LightPeers:     100,
 	DatabaseCache:  512,
@@ -116,6 +118,9 @@ type Config struct {
 	// Ethash options
 	Ethash ethash.Config
 
+	// Algorand protocol options
+	Algorand algorand.ProtocolConfig
+
 	// Transaction pool options
 	TxPool core.TxPoolConfig
 
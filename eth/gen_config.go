@@ -8,6 +8,7 @@ import (
 
 	"github.com/kaleidochain/kaleido/common"
 	"github.com/kaleidochain/kaleido/common/hexutil"
+	"github.com/kaleidochain/kaleido/consensus/algorand"
 	"github.com/kaleidochain/kaleido/consensus/ethash"
 	"github.com/kaleidochain/kaleido/core"
 	"github.com/kaleidochain/kaleido/eth/downloader"
@@ -40,6 +41,7 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		MinerRecommit           time.Duration
 		MinerNoverify           bool
 		Ethash                  ethash.Config
+		Algorand                algorand.ProtocolConfig
 		TxPool                  core.TxPoolConfig
 		GPO                     gasprice.Config
 		EnablePreimageRecording bool
@@ -70,6 +72,7 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.MinerRecommit = c.MinerRecommit
 	enc.MinerNoverify = c.MinerNoverify
 	enc.Ethash = c.Ethash
+	enc.Algorand = c.Algorand
 	enc.TxPool = c.TxPool
 	enc.GPO = c.GPO
 	enc.EnablePreimageRecording = c.EnablePreimageRecording
@@ -104,6 +107,7 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		MinerRecommit           *time.Duration
 		MinerNoverify           *bool
 		Ethash                  *ethash.Config
+		Algorand                *algorand.ProtocolConfig
 		TxPool                  *core.TxPoolConfig
 		GPO                     *gasprice.Config
 		EnablePreimageRecording *bool
@@ -179,6 +183,9 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.Ethash != nil {
 		c.Ethash = *dec.Ethash
 	}
+	if dec.Algorand != nil {
+		c.Algorand = *dec.Algorand
+	}
 	if dec.TxPool != nil {
 		c.TxPool = *dec.TxPool
 	}
@@ -20,6 +20,7 @@ package web3ext
 var Modules = map[string]string{
 	"accounting": Accounting_JS,
 	"admin":      Admin_JS,
+	"algorand":   Algorand_JS,
 	"chequebook": Chequebook_JS,
 	"clique":     Clique_JS,
 	"ethash":     Ethash_JS,
@@ -49,6 +50,23 @@ web3._extend({
 });
 `
 
+const Algorand_JS = `
+web3._extend({
+	property: 'algorand',
+	methods: [],
+	properties: [
+		new web3._extend.Property({
+			name: 'status',
+			getter: 'algorand_status'
+		}),
+		new web3._extend.Property({
+			name: 'peers',
+			getter: 'algorand_peers'
+		}),
+	]
+});
+`
+
 const Chequebook_JS = `
 web3._extend({
 	property: 'chequebook',